@@ -1,29 +1,228 @@
+// go-mod-promote updates soft-forked Go modules and opens a pull request with
+// the changes.
+//
+// Exit codes:
+//
+//	0 success
+//	1 other failure
+//	2 config error
+//	3 nothing to do, unless --exit-zero-on-noop is set
+//	4 task or patch failure
+//	5 git or pull request failure
+//	130 interrupted by a signal
 package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	stdlog "log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	gmpapp "github.com/grafana/go-mod-promote/pkg/app"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+	"github.com/grafana/go-mod-promote/pkg/metrics"
 )
 
+const (
+	exitCodeSuccess       = 0
+	exitCodeFailure       = 1
+	exitCodeConfigError   = 2
+	exitCodeNoOp          = 3
+	exitCodeTaskFailure   = 4
+	exitCodeGitHubFailure = 5
+	exitCodeInterrupted   = 130
+)
+
+// exitCode maps the error of a run to the exit code of the process.
+func exitCode(err error) int {
+	var (
+		configErr      gmperr.ErrConfigInvalid
+		downloadErr    gmperr.ErrGoModDownload
+		patchErr       *gmperr.ErrPatchRejected
+		targetErr      gmperr.ErrPatchTargetMissing
+		commandErr     gmperr.ErrCommandsNotAllowed
+		verifyErr      gmperr.ErrGoModVerify
+		checksumErr    gmperr.ErrChecksumMismatch
+		taskErr        gmperr.ErrTask
+		gitErr         gmperr.ErrGit
+		stashErr       gmperr.ErrGitStash
+		dirtyErr       gmperr.ErrDirtyWorkingDir
+		stashPopErr    gmperr.ErrGitStashPop
+		pullRequestErr gmperr.ErrPullRequest
+	)
+	switch {
+	case errors.As(err, &configErr):
+		return exitCodeConfigError
+	case errors.As(err, &downloadErr), errors.As(err, &patchErr), errors.As(err, &targetErr), errors.As(err, &commandErr), errors.As(err, &verifyErr), errors.As(err, &checksumErr), errors.As(err, &taskErr):
+		return exitCodeTaskFailure
+	case errors.As(err, &stashErr), errors.As(err, &dirtyErr), errors.As(err, &stashPopErr), errors.As(err, &pullRequestErr), errors.As(err, &gitErr):
+		return exitCodeGitHubFailure
+	default:
+		return exitCodeFailure
+	}
+}
+
+func fatal(msg string, err error) {
+	stdlog.Printf("%s: %v", msg, err)
+	os.Exit(exitCode(err))
+}
+
+func parseLogLevel(s string) (level.Option, error) {
+	switch s {
+	case "debug":
+		return level.AllowDebug(), nil
+	case "info":
+		return level.AllowInfo(), nil
+	case "warn":
+		return level.AllowWarn(), nil
+	case "error":
+		return level.AllowError(), nil
+	default:
+		return nil, fmt.Errorf("unknown log level '%s'", s)
+	}
+}
+
+// splitList splits a comma separated flag value, ignoring empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func defaultLogLevel() string {
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		return v
+	}
+	return "info"
+}
+
+// signalContext returns a context, which is cancelled on SIGINT or SIGTERM.
+// A second signal terminates the process immediately.
+func signalContext(logger log.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			level.Warn(logger).Log("msg", "received signal, aborting run", "signal", sig)
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(signals)
+		}
+	}()
+	return ctx, cancel
+}
+
 func main() {
+	var (
+		configPath    = flag.String("config", "", "Path to the config file, by default .go-mod-promote.yaml is searched in the current and parent directories.")
+		dryRun        = flag.Bool("dry-run", false, "Compute the changes without applying, committing or pushing them.")
+		logLevel      = flag.String("log-level", defaultLogLevel(), "Log level, one of: debug, info, warn, error. Defaults to $LOG_LEVEL if set.")
+		pkg           = flag.String("package", "", "Limit the run to a single configured package.")
+		reportPath    = flag.String("report", "", "Write a JSON report of the run to this path.")
+		only          = flag.String("only", "", "Comma separated list of configured packages to limit the run to.")
+		skip          = flag.String("skip", "", "Comma separated list of configured packages to exclude from the run.")
+		keepGoing     = flag.Bool("keep-going", false, "Skip packages which fail and promote the remaining ones.")
+		noPush        = flag.Bool("no-push", false, "Commit the changes to a local branch, without pushing it or creating a pull request.")
+		allowDirty    = flag.Bool("allow-dirty", false, "Run in a dirty working directory, its changes are stashed during the run.")
+		exitZero      = flag.Bool("exit-zero-on-noop", false, "Exit with 0 instead of 3, if there is nothing to do.")
+		metricsAddr   = flag.String("metrics-addr", "", "Serve prometheus metrics on this address during the run, e.g. :9090.")
+		metricsLinger = flag.Duration("metrics-linger", 0, "Keep serving metrics for this duration after the run, so the final values can be scraped.")
+	)
+	flag.Parse()
+
+	levelOption, err := parseLogLevel(*logLevel)
+	if err != nil {
+		stdlog.Fatalf("error parsing flags: %v", err)
+	}
+
 	var logger log.Logger
 	logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 	logger = log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
 	stdlog.SetOutput(log.NewStdlibAdapter(logger))
 
-	app, err := gmpapp.New(gmpapp.WithLogger(logger))
+	opts := []gmpapp.Option{
+		gmpapp.WithLogger(logger),
+		gmpapp.WithLogLevel(levelOption),
+		gmpapp.WithDryRun(*dryRun),
+		gmpapp.WithPackage(*pkg),
+		gmpapp.WithReportPath(*reportPath),
+		gmpapp.WithPackageFilter(splitList(*only)),
+		gmpapp.WithPackageSkip(splitList(*skip)),
+		gmpapp.WithKeepGoing(*keepGoing),
+		gmpapp.WithAllowDirty(*allowDirty),
+		gmpapp.WithCommitOnly(*noPush),
+	}
+	if *configPath != "" {
+		opts = append(opts, gmpapp.WithConfigPath(*configPath))
+	}
+	if *metricsAddr != "" {
+		reg := prometheus.NewRegistry()
+		opts = append(opts, gmpapp.WithMetrics(metrics.New(reg)))
+
+		// listen before the run, so an unusable address fails straight away
+		listener, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			fatal("error starting metrics server", gmperr.ErrConfigInvalid{Err: fmt.Errorf("unusable --metrics-addr: %w", err)})
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		go func() {
+			if err := http.Serve(listener, mux); err != nil {
+				level.Error(logger).Log("msg", "metrics server failed", "err", err)
+			}
+		}()
+	}
+
+	app, err := gmpapp.New(opts...)
 	if err != nil {
-		stdlog.Fatalf("error creating app: %v", err)
+		fatal("error creating app", err)
 	}
 
-	ctx := context.Background()
-	err = app.Run(ctx)
+	ctx, cancel := signalContext(logger)
+	defer cancel()
+	result, err := app.RunWithResult(ctx)
+	if *metricsAddr != "" && *metricsLinger > 0 {
+		level.Info(logger).Log("msg", "serving metrics after the run", "addr", *metricsAddr, "duration", *metricsLinger)
+		select {
+		case <-ctx.Done():
+		case <-time.After(*metricsLinger):
+		}
+	}
 	if err != nil {
-		stdlog.Fatalf("error running app: %v", err)
+		if ctx.Err() != nil {
+			stdlog.Printf("run interrupted: %v", err)
+			os.Exit(exitCodeInterrupted)
+		}
+		fatal("error running app", err)
+	}
+	if result.PullRequestURL != "" {
+		level.Info(logger).Log("msg", "created pull request", "url", result.PullRequestURL, "branch", result.Branch, "packages", strings.Join(result.UpdatedPackages(), ","))
+	}
+	if result.CommitOnly && !result.NoOp && result.Branch != "" {
+		level.Info(logger).Log("msg", "committed changes locally", "branch", result.Branch, "packages", strings.Join(result.UpdatedPackages(), ","))
+	}
+	if result.NoOp && !*exitZero {
+		os.Exit(exitCodeNoOp)
 	}
+	os.Exit(exitCodeSuccess)
 }
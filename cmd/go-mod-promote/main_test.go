@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/go-multierror"
+	pkgerrors "github.com/pkg/errors"
+
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "other", err: errors.New("boom"), want: exitCodeFailure},
+		{name: "config", err: gmperr.ErrConfigInvalid{Err: errors.New("boom")}, want: exitCodeConfigError},
+		{name: "download", err: gmperr.ErrGoModDownload{Path: "example.com/up"}, want: exitCodeTaskFailure},
+		{name: "patch rejected", err: &gmperr.ErrPatchRejected{}, want: exitCodeTaskFailure},
+		{name: "patch target missing", err: gmperr.ErrPatchTargetMissing{}, want: exitCodeTaskFailure},
+		{name: "commands not allowed", err: gmperr.ErrCommandsNotAllowed{Command: "make"}, want: exitCodeTaskFailure},
+		{name: "verify", err: gmperr.ErrGoModVerify{}, want: exitCodeTaskFailure},
+		{name: "checksum mismatch", err: gmperr.ErrChecksumMismatch{}, want: exitCodeTaskFailure},
+		{name: "task", err: gmperr.ErrTask{Err: errors.New("boom")}, want: exitCodeTaskFailure},
+		{name: "git", err: gmperr.ErrGit{Err: errors.New("boom")}, want: exitCodeGitHubFailure},
+		{name: "stash", err: gmperr.ErrGitStash{Err: errors.New("boom")}, want: exitCodeGitHubFailure},
+		{name: "stash pop", err: gmperr.ErrGitStashPop{Err: errors.New("boom")}, want: exitCodeGitHubFailure},
+		{name: "dirty working dir", err: gmperr.ErrDirtyWorkingDir{}, want: exitCodeGitHubFailure},
+		{name: "pull request", err: gmperr.ErrPullRequest{Err: errors.New("boom")}, want: exitCodeGitHubFailure},
+		{name: "wrapped with %w", err: fmt.Errorf("error processing package example.com/up: %w", gmperr.ErrTask{Err: errors.New("boom")}), want: exitCodeTaskFailure},
+		{name: "wrapped with errors.Wrap", err: pkgerrors.Wrap(gmperr.ErrGit{Err: errors.New("boom")}, "error pushing"), want: exitCodeGitHubFailure},
+		{name: "multierror", err: multierror.Append(nil, errors.New("boom"), fmt.Errorf("error processing package example.com/up: %w", &gmperr.ErrPatchRejected{})), want: exitCodeTaskFailure},
+		{name: "multierror of config and task", err: multierror.Append(nil, gmperr.ErrTask{}, gmperr.ErrConfigInvalid{}), want: exitCodeConfigError},
+		{name: "multierror wrapped with errors.Wrap", err: pkgerrors.Wrap(multierror.Append(nil, gmperr.ErrPullRequest{}), "error running"), want: exitCodeGitHubFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exitCode(tc.err); got != tc.want {
+				t.Errorf("expected exit code %d, got %d for %v", tc.want, got, tc.err)
+			}
+		})
+	}
+}
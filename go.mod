@@ -3,12 +3,14 @@ module github.com/grafana/go-mod-promote
 go 1.15
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-kit/kit v0.10.0
 	github.com/google/go-github/v33 v33.0.0
 	github.com/hashicorp/errwrap v1.0.0
 	github.com/hashicorp/go-multierror v1.1.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.3.0
 	golang.org/x/mod v0.4.1
 	golang.org/x/oauth2 v0.0.0-20190226205417-e64efc72b421
 	gopkg.in/yaml.v2 v2.4.0
@@ -1,22 +1,48 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
+
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
 )
 
 type GoModVersion string
 
+// pseudoVersionRE matches pseudo-versions, as defined by golang.org/x/mod/module
+var pseudoVersionRE = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)\d{14}-[A-Za-z0-9]+(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// IsPseudo returns true if the version is a pseudo-version referring to a
+// commit rather than a tag.
+func (v GoModVersion) IsPseudo() bool {
+	return strings.Count(string(v), "-") >= 2 && semver.IsValid(string(v)) && pseudoVersionRE.MatchString(string(v))
+}
+
+// Release returns the version without build metadata (e.g. +incompatible)
+// and for pseudo-versions without the commit specific suffix.
 func (v GoModVersion) Release() string {
-	prerelease := semver.Prerelease(string(v))
 	version := semver.Canonical(string(v))
-	version = version[:len(version)-len(prerelease)]
-	return version
+	if !v.IsPseudo() {
+		return version
+	}
+	prerelease := semver.Prerelease(version)
+	return version[:len(version)-len(prerelease)]
 }
 
+// Hash returns the commit hash of pseudo-versions, it is empty for tags.
 func (v GoModVersion) Hash() string {
+	if !v.IsPseudo() {
+		return ""
+	}
 	prerelease := semver.Prerelease(string(v))
 	pos := strings.LastIndex(prerelease, "-") + 1
 	return prerelease[pos:]
@@ -32,6 +58,7 @@ type GoModDownloadResult struct {
 type GoModReplacePriority int32
 
 const (
+	GoModReplacePriorityLocal          = GoModReplacePriority(2000)
 	GoModReplacePriorityManagedPackage = GoModReplacePriority(1000)
 	GoModReplaceUpstreamPackageVersion = GoModReplacePriority(400)
 	GoModReplaceUpstreamReplace        = GoModReplacePriority(200)
@@ -45,3 +72,97 @@ type GoModReplace struct {
 	// (e.g. remove it after it has been removed upstream)
 	Comment string
 }
+
+// GoModRequire is a require directive of a go.mod file
+type GoModRequire struct {
+	module.Version
+	Indirect bool
+	// Comments are the comments attached to the directive, apart from the
+	// indirect marker
+	Comments []string
+}
+
+// FSRetry configures how filesystem operations are retried, when they fail
+// with transient errors.
+type FSRetry struct {
+	// Attempts is the maximum number of attempts for an operation
+	Attempts int `yaml:"attempts" json:"attempts"`
+	// Backoff is the wait before the first retry, it doubles for every retry
+	Backoff time.Duration `yaml:"backoff" json:"backoff"`
+	// Errors lists the errno names (e.g. EAGAIN) considered transient
+	Errors []string `yaml:"errors" json:"errors"`
+}
+
+// UnmarshalJSON decodes Backoff from a duration string like "100ms", in the
+// same way the YAML config does.
+func (r *FSRetry) UnmarshalJSON(data []byte) error {
+	type plain FSRetry
+	aux := struct {
+		*plain
+		Backoff json.RawMessage `json:"backoff"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return gmperr.ErrConfigInvalid{Err: err}
+	}
+	if len(aux.Backoff) == 0 || string(aux.Backoff) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(aux.Backoff, &s); err == nil {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid backoff '%s': %w", s, err)
+		}
+		r.Backoff = d
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(aux.Backoff, &n); err != nil {
+		return fmt.Errorf("invalid backoff %s: %w", string(aux.Backoff), err)
+	}
+	r.Backoff = time.Duration(n)
+	return nil
+}
+
+// FSRetryErrnos maps the errno names, which can be listed in FSRetry.Errors,
+// to their value.
+var FSRetryErrnos = map[string]syscall.Errno{
+	"EAGAIN":    syscall.EAGAIN,
+	"EBUSY":     syscall.EBUSY,
+	"EINTR":     syscall.EINTR,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+}
+
+// Validate returns an error, if Errors lists an unknown errno name.
+func (r *FSRetry) Validate() error {
+	for _, name := range r.Errors {
+		if _, ok := FSRetryErrnos[name]; !ok {
+			known := make([]string, 0, len(FSRetryErrnos))
+			for name := range FSRetryErrnos {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown errno '%s' in fs_retry, use one of %s", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+var DefaultFSRetry = FSRetry{
+	Attempts: 3,
+	Backoff:  100 * time.Millisecond,
+	Errors:   []string{"EAGAIN", "EBUSY"},
+}
+
+// NetworkRetry configures how operations depending on the network are
+// retried, when they fail with transient errors.
+type NetworkRetry struct {
+	// Attempts is the maximum number of attempts for an operation
+	Attempts int
+	// Backoff is the wait before the first retry, it doubles for every retry
+	Backoff time.Duration
+}
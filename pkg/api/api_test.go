@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFSRetryUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: `{"backoff": "250ms"}`, want: 250 * time.Millisecond},
+		{input: `{"backoff": 1000}`, want: time.Microsecond},
+		{input: `{}`},
+		{input: `{"backoff": "soon"}`, wantErr: true},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			var r FSRetry
+			err := json.Unmarshal([]byte(tc.input), &r)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if r.Backoff != tc.want {
+				t.Errorf("expected backoff %s, got %s", tc.want, r.Backoff)
+			}
+		})
+	}
+}
+
+func TestGoModVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version     GoModVersion
+		wantPseudo  bool
+		wantRelease string
+		wantHash    string
+	}{
+		{version: "v1.2.3", wantRelease: "v1.2.3"},
+		{version: "v1.0.0-rc.1", wantRelease: "v1.0.0-rc.1"},
+		{version: "v2.0.0+incompatible", wantRelease: "v2.0.0"},
+		{version: "v0.0.0-20210101000000-abcdef123456", wantPseudo: true, wantRelease: "v0.0.0", wantHash: "abcdef123456"},
+		{version: "v1.2.4-0.20210101000000-abcdef123456", wantPseudo: true, wantRelease: "v1.2.4", wantHash: "abcdef123456"},
+		{version: "v1.2.4-rc.1.0.20210101000000-abcdef123456", wantPseudo: true, wantRelease: "v1.2.4", wantHash: "abcdef123456"},
+		{version: "v2.0.1-0.20210101000000-abcdef123456+incompatible", wantPseudo: true, wantRelease: "v2.0.1", wantHash: "abcdef123456"},
+		{version: "v1.0.0-alpha-beta", wantRelease: "v1.0.0-alpha-beta"},
+	} {
+		t.Run(string(tc.version), func(t *testing.T) {
+			if got := tc.version.IsPseudo(); got != tc.wantPseudo {
+				t.Errorf("IsPseudo: expected %v, got %v", tc.wantPseudo, got)
+			}
+			if got := tc.version.Release(); got != tc.wantRelease {
+				t.Errorf("Release: expected %s, got %s", tc.wantRelease, got)
+			}
+			if got := tc.version.Hash(); got != tc.wantHash {
+				t.Errorf("Hash: expected %s, got %s", tc.wantHash, got)
+			}
+		})
+	}
+}
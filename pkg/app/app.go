@@ -4,10 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -15,24 +20,67 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 	"gopkg.in/yaml.v2"
 
 	"github.com/grafana/go-mod-promote/pkg/api"
 	"github.com/grafana/go-mod-promote/pkg/command"
 	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
 	"github.com/grafana/go-mod-promote/pkg/github"
 	"github.com/grafana/go-mod-promote/pkg/gomod"
+	"github.com/grafana/go-mod-promote/pkg/metrics"
 	"github.com/grafana/go-mod-promote/pkg/tasks"
 )
 
 const configFile = ".go-mod-promote.yaml"
 const AppName = "go-mod-promote"
 
+// retryAttempts and retryBackoff control the retries of commands and tasks
+// depending on the network
+const (
+	retryAttempts = 3
+	retryBackoff  = 2 * time.Second
+)
+
+const (
+	botName  = "Grafanabot go-mod-vendor"
+	botEmail = "bot@grafana.com"
+)
+
+// ModDownloader downloads a module into the module cache. The path is an
+// argument to go mod download like module@version or module@branch, it is
+// resolved using the go.mod of the module path in the context. The result
+// carries the exact version the path resolved to.
+type ModDownloader interface {
+	Download(ctx context.Context, path string) (*api.GoModDownloadResult, error)
+}
+
+// ModDownloaderFunc allows to use a function as ModDownloader, e.g. to fake
+// downloads in tests.
+type ModDownloaderFunc func(ctx context.Context, path string) (*api.GoModDownloadResult, error)
+
+func (f ModDownloaderFunc) Download(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
+	return f(ctx, path)
+}
+
+// goModDownloader is the default ModDownloader running go mod download.
+type goModDownloader struct{}
+
+func (goModDownloader) Download(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
+	return goModDownload(ctx, path)
+}
+
 func goModDownload(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
-	cmd := command.New(ctx, "go", "mod", "download", "-json", path)
+	modulePath, err := gmpctx.ModulePathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmd := command.New(ctx, "go", "mod", "download", "-json", path).WithDir(modulePath)
 
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("error getting go mod download metadata (%s): %w", cmd.Stderr.String(), err)
+	if err := cmd.RunWithRetry(retryAttempts, retryBackoff); err != nil {
+		return nil, gmperr.ErrGoModDownload{Path: path, Output: cmd.Stderr.String(), Err: err}
 	}
 	var result api.GoModDownloadResult
 
@@ -43,25 +91,340 @@ func goModDownload(ctx context.Context, path string) (*api.GoModDownloadResult,
 	return &result, nil
 }
 
+// goModLatestRelease returns the highest version of a module, which is not a
+// prerelease.
+func goModLatestRelease(ctx context.Context, path string) (string, error) {
+	modulePath, err := gmpctx.ModulePathFromContextOrError(ctx)
+	if err != nil {
+		return "", err
+	}
+	cmd := command.New(ctx, "go", "list", "-m", "-versions", "-json", path).WithDir(modulePath)
+
+	if err := cmd.RunWithRetry(retryAttempts, retryBackoff); err != nil {
+		return "", fmt.Errorf("error listing versions of %s (%s): %w", path, cmd.Stderr.String(), err)
+	}
+	var result struct {
+		Versions []string
+	}
+	if err := json.Unmarshal(cmd.Stdout.Bytes(), &result); err != nil {
+		return "", err
+	}
+
+	var latest string
+	for _, v := range result.Versions {
+		if !semver.IsValid(v) || semver.Prerelease(v) != "" {
+			continue
+		}
+		if latest == "" || semver.Compare(v, latest) > 0 {
+			latest = v
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no release found for %s", path)
+	}
+
+	return latest, nil
+}
+
+// downloadCache memoizes the results of a ModDownloader for the duration of a
+// run. Concurrent downloads of the same argument wait for the first one.
+type downloadCache struct {
+	downloader ModDownloader
+
+	mu      sync.Mutex
+	entries map[string]*downloadCacheEntry
+}
+
+type downloadCacheEntry struct {
+	once   sync.Once
+	result *api.GoModDownloadResult
+	err    error
+}
+
+func newDownloadCache(downloader ModDownloader) *downloadCache {
+	return &downloadCache{
+		downloader: downloader,
+		entries:    make(map[string]*downloadCacheEntry),
+	}
+}
+
+// download returns the cached result for path. Arguments without a version
+// are resolved using the go.mod of the module path, so it is part of the key.
+func (c *downloadCache) download(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
+	modulePath, err := gmpctx.ModulePathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := modulePath + "\x00" + path
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &downloadCacheEntry{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.result, entry.err = c.downloader.Download(ctx, path)
+	})
+	if ok && entry.err == nil {
+		level.Debug(gmpctx.LoggerFromContext(ctx)).Log("msg", "using cached go mod download result", "path", path)
+	}
+	return entry.result, entry.err
+}
+
 type Config struct {
-	Packages map[string]Package `yaml:"packages"`
+	Packages map[string]Package `yaml:"packages" json:"packages"`
 
-	GitHub GitHub `yaml:"github"`
+	GitHub GitHub `yaml:"github" json:"github"`
+
+	Git Git `yaml:"git" json:"git"`
+
+	// ModulePath is the directory containing go.mod relative to the config
+	// file, it defaults to the directory of the config file.
+	ModulePath string `yaml:"module_path" json:"module_path"`
+
+	// Modules configures the packages of further modules in the same
+	// repository, each is updated in its own go.mod.
+	Modules []Module `yaml:"modules" json:"modules"`
 
 	// If VendorDirectory is set to true, go mod vendor will be called after
 	// changes to vendoring
-	VendorDirectory bool `yaml:"vendor_directory"`
+	VendorDirectory bool `yaml:"vendor_directory" json:"vendor_directory"`
+
+	// If TidyModule is set to true, go mod tidy will be called after go.mod
+	// has been updated
+	TidyModule bool `yaml:"tidy_module" json:"tidy_module"`
+
+	// VerifyCommand replaces go mod verify as verification of the updated
+	// module, it is run in the root path.
+	VerifyCommand []string `yaml:"verify_command" json:"verify_command"`
+
+	// If AutoUpdateGoSum is set to true, go mod download is run and the
+	// verification retried once, when go mod verify fails because of missing
+	// go.sum entries or a modified module cache.
+	AutoUpdateGoSum bool `yaml:"auto_update_gosum" json:"auto_update_gosum"`
+
+	// MinGoVersion and MaxGoVersion limit the go directive of upstream
+	// packages, updates outside of that range are refused.
+	MinGoVersion string `yaml:"min_go_version" json:"min_go_version"`
+	MaxGoVersion string `yaml:"max_go_version" json:"max_go_version"`
+
+	// If GoVersionWarnOnly is set to true, updates outside of the go version
+	// range are only logged and not refused.
+	GoVersionWarnOnly bool `yaml:"go_version_warn_only" json:"go_version_warn_only"`
+
+	// Concurrency limits how many packages are downloaded and processed in
+	// parallel, it defaults to the number of CPUs.
+	Concurrency int `yaml:"concurrency" json:"concurrency"`
+
+	// If PatchFile is set, all patches of a run including the go.mod changes
+	// are combined into a single patch and written to that path, also in
+	// dry-run. It is relative to the config file and must be outside of the
+	// git work tree.
+	PatchFile string `yaml:"patch_file" json:"patch_file"`
+
+	// FSRetry configures retries of filesystem operations failing with
+	// transient errors.
+	FSRetry *api.FSRetry `yaml:"fs_retry" json:"fs_retry"`
+
+	// If Strict is set to true, a config without any packages is treated as
+	// an error rather than a warning.
+	Strict bool `yaml:"strict" json:"strict"`
+
+	// If PruneRemovedPackages is set to true, managed replaces originating
+	// from packages no longer in the config are removed.
+	PruneRemovedPackages bool `yaml:"prune_removed_packages" json:"prune_removed_packages"`
+
+	// If KeepRejects is set to true, hunks of patches which fail to apply are
+	// written to reject files in the root path.
+	KeepRejects bool `yaml:"keep_rejects" json:"keep_rejects"`
+
+	// If DeterministicBranchName is set to true, the branch name is derived
+	// from the updated packages and versions rather than the current time.
+	DeterministicBranchName bool `yaml:"deterministic_branch_name" json:"deterministic_branch_name"`
+
+	// BranchTemplate is a go template rendering the branch name. It can refer
+	// to .Timestamp, .Packages (the updated module paths) and .Hash (derived
+	// from the updated packages and versions). Existing branches of the bot
+	// are only reused, when the rendered name is stable, e.g. by using .Hash.
+	// Defaults to vendor_go-mod-promote_{{ .Timestamp }}, or
+	// vendor_go-mod-promote_{{ .Hash }} with DeterministicBranchName.
+	BranchTemplate string `yaml:"branch_template" json:"branch_template"`
+
+	// ReportFile is the path a JSON report of the run is written to
+	ReportFile string `yaml:"report_file" json:"report_file"`
+
+	// If ContinueOnError is set to true, packages which fail are skipped and
+	// the remaining ones are still promoted.
+	ContinueOnError bool `yaml:"continue_on_error" json:"continue_on_error"`
+
+	// If RestoreBranch is set to true, the branch checked out before the run
+	// is checked out again after the pull request has been created. Defaults
+	// to true.
+	RestoreBranch *bool `yaml:"restore_branch" json:"restore_branch"`
+
+	// If FollowGoDirective is set to true, the go directive is raised to the
+	// one of updated packages, if they require a newer go version.
+	FollowGoDirective bool `yaml:"follow_go_directive" json:"follow_go_directive"`
+
+	// If RollbackOnFailure is set to true, changes to the working directory
+	// are discarded, when the run fails before they have been committed.
+	// Reject files written because of KeepRejects are kept.
+	RollbackOnFailure bool `yaml:"rollback_on_failure" json:"rollback_on_failure"`
+
+	// PrivateModules lists module path patterns, which are fetched directly
+	// and not checked against the checksum database, they are added to
+	// GOPRIVATE.
+	PrivateModules []string `yaml:"private_modules" json:"private_modules"`
+
+	// If AllowCommands is set to true, command tasks are allowed to run
+	// arbitrary executables.
+	AllowCommands bool `yaml:"allow_commands" json:"allow_commands"`
+}
+
+func (a *App) continueOnError() bool {
+	return a.keepGoing || a.cfg.ContinueOnError
+}
+
+func (c *Config) restoreBranch() bool {
+	if c.RestoreBranch == nil {
+		return true
+	}
+	return *c.RestoreBranch
+}
+
+const (
+	defaultBranchTemplate              = "vendor_go-mod-promote_{{ .Timestamp }}"
+	defaultDeterministicBranchTemplate = "vendor_go-mod-promote_{{ .Hash }}"
+)
+
+func (c *Config) branchTemplate() (*template.Template, error) {
+	text := c.BranchTemplate
+	if text == "" {
+		text = defaultBranchTemplate
+		if c.DeterministicBranchName {
+			text = defaultDeterministicBranchTemplate
+		}
+	}
+	tmpl, err := template.New("branch_template").Funcs(branchTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid branch_template: %w", err)
+	}
+	return tmpl, nil
 }
 
 type GitHub struct {
 	Owner string
 	Repo  string
+	Auth  GitHubAuth `yaml:"auth" json:"auth"`
+
+	// Labels, Reviewers and TeamReviewers are added to the created PR
+	Labels        []string `yaml:"labels" json:"labels"`
+	Reviewers     []string `yaml:"reviewers" json:"reviewers"`
+	TeamReviewers []string `yaml:"team_reviewers" json:"team_reviewers"`
+
+	// If Draft is set to true, the PR is opened as draft
+	Draft bool `yaml:"draft" json:"draft"`
+}
+
+type Git struct {
+	// Remote is the name of the remote the branch is pushed to, using the
+	// credentials configured for it. If owner or repo of the GitHub config
+	// are not set, they are derived from the remote's URL. By default the
+	// branch is pushed to the GitHub repository using the GitHub credentials.
+	Remote string `yaml:"remote" json:"remote"`
+
+	// If SignCommits is set to true, the commit is signed using the signing
+	// setup of the git config (gpg.format, user.signingKey). SigningKey
+	// overrides the configured key.
+	SignCommits bool   `yaml:"sign_commits" json:"sign_commits"`
+	SigningKey  string `yaml:"signing_key" json:"signing_key"`
+}
+
+type GitHubAuth struct {
+	// Type is either token (default), which uses the GITHUB_TOKEN environment
+	// variable, or app, which authenticates as GitHub App installation
+	Type           string `yaml:"type" json:"type"`
+	AppID          int64  `yaml:"app_id" json:"app_id"`
+	InstallationID int64  `yaml:"installation_id" json:"installation_id"`
+	// PrivateKeyPath points to the App's private key, if not set it is read
+	// from the GITHUB_APP_PRIVATE_KEY environment variable
+	PrivateKeyPath string `yaml:"private_key_path" json:"private_key_path"`
+}
+
+type Module struct {
+	// Path is the directory containing go.mod relative to the config file
+	Path     string             `yaml:"path" json:"path"`
+	Packages map[string]Package `yaml:"packages" json:"packages"`
 }
 
 type Package struct {
-	RemoteURL string       `yaml:"remote_url"`
-	Branch    string       `yaml:"branch"`
-	Tasks     []tasks.Task `yaml:"tasks"`
+	RemoteURL string       `yaml:"remote_url" json:"remote_url"`
+	Branch    string       `yaml:"branch" json:"branch"`
+	Tasks     []tasks.Task `yaml:"tasks" json:"tasks"`
+
+	// If ResolveViaProxy is set to true, the branch is resolved to its current
+	// commit using the module proxy instead of fetching it from the VCS. The
+	// proxy might lag behind the VCS, resolving to a version older than the
+	// one in go.mod fails the package.
+	ResolveViaProxy bool `yaml:"resolve_via_proxy" json:"resolve_via_proxy"`
+
+	// Tag or Commit pin the package to an exact upstream revision, instead of
+	// tracking a branch. Only one of Branch, Tag and Commit can be set.
+	Tag    string `yaml:"tag" json:"tag"`
+	Commit string `yaml:"commit" json:"commit"`
+
+	// Track selects how the upstream revision is picked, either "branch"
+	// (default) or "latest_release", which promotes to the highest semver tag
+	// without a prerelease.
+	Track string `yaml:"track" json:"track"`
+
+	// If RequireTaskChanges is set to true, the package is only updated if
+	// its tasks produce changes.
+	RequireTaskChanges bool `yaml:"require_task_changes" json:"require_task_changes"`
+}
+
+const (
+	trackBranch        = "branch"
+	trackLatestRelease = "latest_release"
+)
+
+// ref returns the upstream revision to promote, it defaults to the master
+// branch.
+func (p *Package) ref() (ref string, isBranch bool, err error) {
+	set := 0
+	for _, v := range []string{p.Branch, p.Tag, p.Commit} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", false, fmt.Errorf("only one of branch, tag and commit can be set")
+	}
+
+	switch p.Track {
+	case "", trackBranch:
+	case trackLatestRelease:
+		if set > 0 {
+			return "", false, fmt.Errorf("branch, tag and commit can't be set when tracking %s", trackLatestRelease)
+		}
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("unknown track '%s'", p.Track)
+	}
+
+	switch {
+	case p.Tag != "":
+		return p.Tag, false, nil
+	case p.Commit != "":
+		return p.Commit, false, nil
+	case p.Branch != "":
+		return p.Branch, true, nil
+	default:
+		return "master", true, nil
+	}
 }
 
 type Option func(*App)
@@ -72,69 +435,351 @@ func WithLogger(logger logkit.Logger) Option {
 	}
 }
 
+// WithLogLevel filters the log output of the app by the given level.
+func WithLogLevel(lvl level.Option) Option {
+	return func(a *App) {
+		a.logLevel = lvl
+	}
+}
+
+// WithConfigPath loads the config from the given path instead of searching
+// for it in the current and parent directories. The directory containing the
+// config file is used as the root path of the repository.
+func WithConfigPath(path string) Option {
+	return func(a *App) {
+		a.configPath = path
+	}
+}
+
+// WithDryRun computes the changes of a run without applying them.
+func WithDryRun(dryRun bool) Option {
+	return func(a *App) {
+		a.dryRun = dryRun
+	}
+}
+
+// WithReportPath writes a JSON report of the run to the given path, it takes
+// precedence over the report_file config.
+func WithReportPath(path string) Option {
+	return func(a *App) {
+		a.reportPath = path
+	}
+}
+
+// WithPackage limits the run to a single configured package.
+func WithPackage(pkg string) Option {
+	return func(a *App) {
+		if pkg != "" {
+			a.onlyPackages = append(a.onlyPackages, pkg)
+		}
+	}
+}
+
+// WithKeepGoing skips packages which fail and promotes the remaining ones, as
+// if continue_on_error is set in the config.
+func WithKeepGoing(keepGoing bool) Option {
+	return func(a *App) {
+		a.keepGoing = keepGoing
+	}
+}
+
+// WithAllowDirty allows runs in a dirty working directory. The changes are
+// stashed during the run and restored afterwards.
+func WithAllowDirty(allowDirty bool) Option {
+	return func(a *App) {
+		a.allowDirty = allowDirty
+	}
+}
+
+// WithCommitOnly commits the changes to a local branch, without pushing it and
+// creating a pull request.
+func WithCommitOnly(commitOnly bool) Option {
+	return func(a *App) {
+		a.commitOnly = commitOnly
+	}
+}
+
+// WithModDownloader replaces go mod download, which is used to fetch the
+// packages, e.g. by a fake in tests.
+func WithModDownloader(downloader ModDownloader) Option {
+	return func(a *App) {
+		if downloader != nil {
+			a.downloader = downloader
+		}
+	}
+}
+
+// WithMetrics records metrics of the run.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(a *App) {
+		a.metrics = m
+	}
+}
+
+// WithPackageFilter limits the run to the given configured packages.
+func WithPackageFilter(pkgs []string) Option {
+	return func(a *App) {
+		a.onlyPackages = append(a.onlyPackages, pkgs...)
+	}
+}
+
+// WithPackageSkip excludes the given configured packages from the run.
+func WithPackageSkip(pkgs []string) Option {
+	return func(a *App) {
+		a.skipPackages = append(a.skipPackages, pkgs...)
+	}
+}
+
 type App struct {
-	cfg      *Config
-	rootPath string
+	cfg        *Config
+	configPath string
+	rootPath   string
+	dryRun     bool
+	keepGoing  bool
+	allowDirty bool
+	commitOnly bool
+	reportPath string
+	downloads  *downloadCache
+	downloader ModDownloader
 
-	logger logkit.Logger
+	onlyPackages []string
+	skipPackages []string
+
+	logger   logkit.Logger
+	logLevel level.Option
+	metrics  *metrics.Metrics
 }
 
-func New(opts ...Option) (*App, error) {
+func newApp(opts []Option) *App {
 	app := &App{
-		logger: logkit.NewNopLogger(),
+		logger:     logkit.NewNopLogger(),
+		downloader: goModDownloader{},
 	}
 
 	for _, opt := range opts {
 		opt(app)
 	}
 
+	if app.logLevel == nil {
+		app.logLevel = level.AllowInfo()
+	}
+	app.logger = level.NewFilter(app.logger, app.logLevel)
+
+	return app
+}
+
+// New creates an App from the config file, which is either set using
+// WithConfigPath or found in the working directory or one of its parents.
+func New(opts ...Option) (*App, error) {
+	app := newApp(opts)
+
+	filePath, err := app.findConfig()
+	if err != nil {
+		return nil, gmperr.ErrConfigInvalid{Path: app.configPath, Err: err}
+	}
+	app.configPath = filePath
+	app.rootPath = filepath.Dir(filePath)
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, gmperr.ErrConfigInvalid{Path: filePath, Err: err}
+	}
+	defer f.Close()
+
+	config := &Config{}
+	switch ext := filepath.Ext(filePath); ext {
+	case ".json":
+		err = json.NewDecoder(f).Decode(&config)
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(f).Decode(&config)
+	default:
+		err = fmt.Errorf("unsupported config file extension '%s', use .yaml, .yml or .json", ext)
+	}
+	var cfgErr gmperr.ErrConfigInvalid
+	if errors.As(err, &cfgErr) {
+		cfgErr.Path = filePath
+		return nil, cfgErr
+	} else if err != nil {
+		return nil, gmperr.ErrConfigInvalid{Path: filePath, Err: err}
+	}
+	app.cfg = config
+
+	if err := app.validateConfig(); err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+// NewWithConfig creates an App from an in-memory config, which allows to use
+// it as a library. Paths of the config are relative to rootPath, the
+// repository which is updated. The config is not modified by the App.
+func NewWithConfig(cfg *Config, rootPath string, opts ...Option) (*App, error) {
+	if cfg == nil {
+		return nil, gmperr.ErrConfigInvalid{Err: fmt.Errorf("config must not be nil")}
+	}
+
+	app := newApp(opts)
+
+	var err error
+	app.rootPath, err = filepath.Abs(rootPath)
+	if err != nil {
+		return nil, gmperr.ErrConfigInvalid{Err: err}
+	}
+	if info, err := os.Stat(app.rootPath); err != nil {
+		return nil, gmperr.ErrConfigInvalid{Err: err}
+	} else if !info.IsDir() {
+		return nil, gmperr.ErrConfigInvalid{Err: fmt.Errorf("root path %s is not a directory", app.rootPath)}
+	}
+
+	// copy the config, as filtering the packages modifies it
+	config := *cfg
+	config.Modules = append([]Module(nil), cfg.Modules...)
+	app.cfg = &config
+
+	if err := app.validateConfig(); err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+func (a *App) validateConfig() error {
+	if _, err := a.cfg.branchTemplate(); err != nil {
+		return gmperr.ErrConfigInvalid{Path: a.configPath, Err: err}
+	}
+	if a.cfg.FSRetry != nil {
+		if err := a.cfg.FSRetry.Validate(); err != nil {
+			return gmperr.ErrConfigInvalid{Path: a.configPath, Err: err}
+		}
+	}
+
+	return a.filterPackages()
+}
+
+// filterPackages removes the packages from the config, which are not part of
+// the run. Unknown package names are an error.
+func (a *App) filterPackages() error {
+	if len(a.onlyPackages) == 0 && len(a.skipPackages) == 0 {
+		return nil
+	}
+
+	known := make(map[string]struct{})
+	for pkg := range a.cfg.Packages {
+		known[pkg] = struct{}{}
+	}
+	for _, m := range a.cfg.Modules {
+		for pkg := range m.Packages {
+			known[pkg] = struct{}{}
+		}
+	}
+
+	toSet := func(pkgs []string) (map[string]struct{}, error) {
+		set := make(map[string]struct{}, len(pkgs))
+		for _, pkg := range pkgs {
+			if _, ok := known[pkg]; !ok {
+				return nil, gmperr.ErrConfigInvalid{Path: a.configPath, Err: fmt.Errorf("package '%s' is not configured", pkg)}
+			}
+			set[pkg] = struct{}{}
+		}
+		return set, nil
+	}
+	only, err := toSet(a.onlyPackages)
+	if err != nil {
+		return err
+	}
+	skip, err := toSet(a.skipPackages)
+	if err != nil {
+		return err
+	}
+
+	filter := func(pkgs map[string]Package) map[string]Package {
+		filtered := make(map[string]Package, len(pkgs))
+		for pkg, cfg := range pkgs {
+			if _, ok := only[pkg]; len(only) > 0 && !ok {
+				continue
+			}
+			if _, ok := skip[pkg]; ok {
+				continue
+			}
+			filtered[pkg] = cfg
+		}
+		return filtered
+	}
+	a.cfg.Packages = filter(a.cfg.Packages)
+	for pos := range a.cfg.Modules {
+		a.cfg.Modules[pos].Packages = filter(a.cfg.Modules[pos].Packages)
+	}
+
+	return nil
+}
+
+// findConfig returns the absolute path of the config file, if no path is set
+// explicitly, it is searched in the current and parent directories.
+func (a *App) findConfig() (string, error) {
+	if a.configPath != "" {
+		filePath, err := filepath.Abs(a.configPath)
+		if err != nil {
+			return "", err
+		}
+		if info, err := os.Stat(filePath); err != nil {
+			return "", err
+		} else if info.IsDir() {
+			return "", fmt.Errorf("%s is a directory", filePath)
+		}
+		return filePath, nil
+	}
+
 	// find root path with config file
 	dirPath, err := os.Getwd()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	var filePath string
 	for {
-		filePath = filepath.Join(dirPath, configFile)
+		filePath := filepath.Join(dirPath, configFile)
 
 		if info, err := os.Stat(filePath); os.IsNotExist(err) {
 			if dirPath == "/" {
-				return nil, fmt.Errorf("no config file '%s' exists", configFile)
+				return "", fmt.Errorf("no config file '%s' exists", configFile)
 			}
 			dirPath = filepath.Dir(dirPath)
 			continue
 		} else if err != nil {
-			return nil, err
+			return "", err
 		} else if info.IsDir() {
-			return nil, fmt.Errorf("%s is a directory", filePath)
+			return "", fmt.Errorf("%s is a directory", filePath)
 		}
 
-		break
+		return filePath, nil
 	}
-	app.rootPath = dirPath
-
-	f, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	config := &Config{}
-	if err := yaml.NewDecoder(f).Decode(&config); err != nil {
-		return nil, err
-	}
-	app.cfg = config
-
-	return app, nil
 }
 
 func (a *App) ctx(ctx context.Context) context.Context {
 	ctx = gmpctx.RootPathIntoContext(ctx, a.rootPath)
 	ctx = gmpctx.LoggerIntoContext(ctx, a.logger)
+	ctx = gmpctx.AllowCommandsIntoContext(ctx, a.cfg.AllowCommands)
+	ctx = gmpctx.NetworkRetryIntoContext(ctx, api.NetworkRetry{Attempts: retryAttempts, Backoff: retryBackoff})
+	if a.cfg.FSRetry != nil {
+		ctx = gmpctx.FSRetryIntoContext(ctx, *a.cfg.FSRetry)
+	}
+	if len(a.cfg.PrivateModules) > 0 {
+		ctx = gmpctx.EnvIntoContext(ctx, []string{"GOPRIVATE=" + a.goPrivate()})
+	}
 	return ctx
 }
 
+// goPrivate returns the GOPRIVATE of the environment extended by the
+// configured private modules.
+func (a *App) goPrivate() string {
+	var patterns []string
+	if v := os.Getenv("GOPRIVATE"); v != "" {
+		patterns = append(patterns, v)
+	}
+	patterns = append(patterns, a.cfg.PrivateModules...)
+	return strings.Join(patterns, ",")
+}
+
 type Result interface {
 	IsEmpty() bool
 	Apply(context.Context) error
@@ -145,79 +790,313 @@ type goModUpdateResult struct {
 	pkg       string
 	remoteURL string
 	version   string
+	goVersion string // go directive to raise ours to, if set
 }
 
 func (r *goModUpdateResult) Apply(ctx context.Context) error {
-	return r.goMod.UpdatePackage(r.pkg, r.version)
+	if err := r.goMod.UpdatePackage(r.pkg, r.version); err != nil {
+		return err
+	}
+	if r.goVersion != "" {
+		return r.goMod.RaiseGoVersion(r.goVersion)
+	}
+	return nil
 }
 
 func (r *goModUpdateResult) IsEmpty() bool {
 	return false
 }
 
+type dropReplacesResult struct {
+	goMod    *gomod.GoMod
+	replaces []module.Version
+}
+
+func (r *dropReplacesResult) Apply(ctx context.Context) error {
+	for _, replace := range r.replaces {
+		if err := r.goMod.DropReplace(replace.Path, replace.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *dropReplacesResult) IsEmpty() bool {
+	return len(r.replaces) == 0
+}
+
+// modules returns all configured modules, the packages configured at the top
+// level belong to the module at ModulePath.
+func (a *App) modules() []Module {
+	var modules []Module
+	if len(a.cfg.Packages) > 0 {
+		modules = append(modules, Module{
+			Path:     a.cfg.ModulePath,
+			Packages: a.cfg.Packages,
+		})
+	}
+	for _, m := range a.cfg.Modules {
+		if len(m.Packages) > 0 {
+			modules = append(modules, m)
+		}
+	}
+	return modules
+}
+
+// moduleRun holds the state of a module during a run
+type moduleRun struct {
+	Module
+	ctx   context.Context
+	goMod *gomod.GoMod
+}
+
+// spewDump defers dumping the value until the log line is actually written,
+// so filtered debug logs don't pay for it.
+type spewDump struct {
+	v interface{}
+}
+
+func (d spewDump) String() string {
+	return spew.Sdump(d.v)
+}
+
 func (a *App) Run(ctx context.Context) error {
-	level.Debug(a.logger).Log("running_config", spew.Sdump(a.cfg))
+	_, err := a.RunWithResult(ctx)
+	return err
+}
+
+// RunWithResult runs the promotion like Run and returns a report of it,
+// including the branch name and URL of the created pull request.
+func (a *App) RunWithResult(ctx context.Context) (*RunReport, error) {
+	start := time.Now()
+	report := &RunReport{DryRun: a.dryRun, CommitOnly: a.commitOnly}
+	err := a.run(ctx, report)
+	a.metrics.ObserveRunDuration(time.Since(start))
+
+	reportPath := a.reportPath
+	if reportPath == "" {
+		reportPath = a.cfg.ReportFile
+	}
+	if reportPath != "" {
+		if err != nil {
+			report.Error = err.Error()
+		}
+		if rerr := report.write(reportPath); rerr != nil {
+			level.Warn(a.logger).Log("msg", "unable to write run report", "path", reportPath, "err", rerr)
+		} else {
+			level.Info(a.logger).Log("msg", "wrote run report", "path", reportPath)
+		}
+	}
+
+	return report, err
+}
+
+func (a *App) run(ctx context.Context, report *RunReport) (err error) {
+	level.Debug(a.logger).Log("running_config", spewDump{a.cfg})
 	ctx = a.ctx(ctx)
+	a.downloads = newDownloadCache(a.downloader)
 
-	// TODO: test github token if not a
-	githubToken := os.Getenv("GITHUB_TOKEN")
+	// cleanups need to run to completion, even when the run is cancelled
+	cleanupCtx := a.ctx(context.Background())
 
-	goMod, err := gomod.NewGoModFromContext(ctx)
+	modules := a.modules()
+	if len(modules) == 0 {
+		if a.cfg.Strict {
+			return gmperr.ErrConfigInvalid{Path: a.configPath, Err: errors.New("no packages configured")}
+		}
+		level.Warn(a.logger).Log("msg", "no packages configured, nothing to do", "config", a.configPath)
+		report.NoOp = true
+		return nil
+	}
+
+	// tasks render and download files into a temporary directory, which is
+	// removed once the run finished
+	tempDir, err := ioutil.TempDir("", AppName)
 	if err != nil {
 		return err
 	}
-	ctx = gmpctx.GoModFileIntoContext(ctx, goMod)
+	defer func() {
+		if rerr := os.RemoveAll(tempDir); rerr != nil {
+			level.Warn(a.logger).Log("msg", "Failed to remove temporary directory", "path", tempDir, "error", rerr)
+		}
+	}()
+	ctx = gmpctx.TempDirIntoContext(ctx, tempDir)
+
+	// verify the github credentials before doing any work
+	var gh *github.GitHub
+	var githubUsername string
+	if !a.dryRun && !a.commitOnly {
+		var err error
+		gh, err = a.newGitHub(ctx)
+		if err != nil {
+			return err
+		}
+		githubUsername, err = gh.Username(ctx)
+		if err != nil {
+			return fmt.Errorf("error authenticating to GitHub: %w", err)
+		}
+	}
+
+	// resolve the patch file before doing any work, so it is written
+	// regardless of dry-run
+	var patchFile string
+	if a.cfg.PatchFile != "" {
+		patchFile, err = a.patchFilePath(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// verify the signing key before doing any work
+	if a.cfg.Git.SignCommits && !a.dryRun {
+		if err := gitVerifySigningKey(ctx, a.cfg.Git.SigningKey); err != nil {
+			return fmt.Errorf("commit signing is enabled, but %w", err)
+		}
+	}
+
+	// load the go.mod of every module, the packages of a module see its go.mod
+	// through their context
+	type pkgJob struct {
+		module *moduleRun
+		pkg    string
+	}
+	var (
+		moduleRuns = make([]*moduleRun, len(modules))
+		jobs       []pkgJob
+	)
+	for pos, m := range modules {
+		mr := &moduleRun{Module: m}
+		mr.ctx = gmpctx.ModulePathIntoContext(ctx, filepath.Join(a.rootPath, m.Path))
+		mr.goMod, err = gomod.NewGoModFromContext(mr.ctx)
+		if err != nil {
+			return err
+		}
+		mr.ctx = gmpctx.GoModFileIntoContext(mr.ctx, mr.goMod)
+		moduleRuns[pos] = mr
+
+		pkgs := make([]string, 0, len(m.Packages))
+		for pkg := range m.Packages {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+		for _, pkg := range pkgs {
+			jobs = append(jobs, pkgJob{module: mr, pkg: pkg})
+		}
+	}
+
+	concurrency := a.cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	// download packages and run their tasks in parallel, applying the results
+	// needs to happen serially, as it modifies the working tree
+	var (
+		wg         sync.WaitGroup
+		sem        = make(chan struct{}, concurrency)
+		pkgResults = make([][]Result, len(jobs))
+		pkgErrs    = make([]error, len(jobs))
+	)
+	report.Packages = make([]PackageReport, len(jobs))
+	for pos, job := range jobs {
+		report.Packages[pos].Name = job.pkg
+		report.Packages[pos].Module = job.module.Path
+		wg.Add(1)
+		go func(pos int, job pkgJob) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				pkgErrs[pos] = err
+				return
+			}
+			a.metrics.PackageConsidered()
+			pkgResults[pos], pkgErrs[pos] = a.runPackage(job.module.ctx, job.module.goMod, job.pkg, job.module.Packages[job.pkg], &report.Packages[pos])
+			switch {
+			case pkgErrs[pos] != nil:
+				a.metrics.PackageFailed()
+			case pkgResults[pos] != nil:
+				a.metrics.PackageUpdated()
+			default:
+				a.metrics.PackageSkipped()
+			}
+		}(pos, job)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var pkgErr error
+	var failedPackages []string
+	for pos, err := range pkgErrs {
+		if err != nil {
+			pkgErr = multierror.Append(pkgErr, fmt.Errorf("error processing package %s: %w", jobs[pos].pkg, err))
+			failedPackages = append(failedPackages, fmt.Sprintf("%s: %v", jobs[pos].pkg, err))
+			report.Packages[pos].Error = err.Error()
+			pkgResults[pos] = nil
+		}
+	}
+	if pkgErr != nil {
+		if !a.continueOnError() || len(failedPackages) == len(jobs) {
+			return pkgErr
+		}
+		level.Error(a.logger).Log("msg", "continuing without failed packages", "err", pkgErr)
+		defer func() {
+			if err == nil {
+				level.Error(a.logger).Log("msg", "packages skipped due to errors", "err", pkgErr)
+			}
+		}()
+	}
 
 	var results []Result
+	var resultCtxs []context.Context   // the context of the module each result is applied in
+	var resultReports []*PackageReport // the package report of each result, if any
 	var packagesUpdated []string
-	for pkg, cfg := range a.cfg.Packages {
-		modBefore, err := goModDownload(ctx, pkg)
-		if err != nil {
-			return err
-		}
-		level.Info(a.logger).Log("msg", "existing package version in go.mod", "package", pkg, "version", modBefore.Version.Release(), "hash", modBefore.Version.Hash())
-		ctx = gmpctx.GoModBeforeIntoContext(ctx, modBefore)
-
-		if cfg.Branch == "" {
-			cfg.Branch = "master"
-		}
-		if cfg.RemoteURL == "" {
-			cfg.RemoteURL = pkg
-		}
 
-		modAfter, err := goModDownload(ctx, fmt.Sprintf("%s@%s", cfg.RemoteURL, cfg.Branch))
-		if err != nil {
-			return err
+	if a.cfg.PruneRemovedPackages {
+		for _, mr := range moduleRuns {
+			var sources []string
+			for pkg, cfg := range mr.Packages {
+				sources = append(sources, pkg)
+				if cfg.RemoteURL != "" {
+					sources = append(sources, cfg.RemoteURL)
+				}
+			}
+			orphaned := mr.goMod.OrphanedReplaces(sources)
+			for _, replace := range orphaned {
+				level.Info(a.logger).Log("msg", "managed replace of package removed from config will be dropped", "pkg", replace.Path, "version", replace.Version)
+			}
+			results = append(results, &dropReplacesResult{
+				goMod:    mr.goMod,
+				replaces: orphaned,
+			})
+			resultCtxs = append(resultCtxs, mr.ctx)
+			resultReports = append(resultReports, nil)
 		}
-		level.Info(a.logger).Log("msg", "new package version for go.mod", "package", pkg, "version", modAfter.Version.Release(), "hash", modAfter.Version.Hash())
-		ctx = gmpctx.GoModAfterIntoContext(ctx, modAfter)
+	}
 
-		if modBefore.Version == modAfter.Version {
-			level.Info(a.logger).Log("msg", "versions matching nothing to do", "package", pkg)
+	for pos, pkgResult := range pkgResults {
+		if pkgResult == nil {
 			continue
 		}
-
-		packagesUpdated = append(packagesUpdated, pkg)
-
-		var taskResults = make([]*tasks.Result, len(cfg.Tasks))
-		for pos, task := range cfg.Tasks {
-			var err error
-			taskResults[pos], err = task.Run(ctx)
-			if err != nil {
-				return err
-			}
+		packagesUpdated = append(packagesUpdated, jobs[pos].pkg)
+		results = append(results, pkgResult...)
+		for range pkgResult {
+			resultCtxs = append(resultCtxs, jobs[pos].module.ctx)
+			resultReports = append(resultReports, &report.Packages[pos])
 		}
+	}
 
-		// add results to global results
-		results = append(results,
-			&goModUpdateResult{
-				goMod:     goMod,
-				pkg:       pkg,
-				remoteURL: cfg.RemoteURL,
-				version:   modAfter.Version.Hash(),
-			},
-			tasks.AggregateResult(taskResults...),
-		)
+	// make sure no two tasks change the same file
+	var taskResults []*tasks.Result
+	for _, r := range results {
+		if taskResult, ok := r.(*tasks.Result); ok {
+			taskResults = append(taskResults, taskResult)
+		}
+	}
+	if err := tasks.CheckConflicts(ctx, taskResults...); err != nil {
+		return err
 	}
 
 	// exit here if there is nothing to do
@@ -230,20 +1109,60 @@ func (a *App) Run(ctx context.Context) error {
 	}
 	if !workToDo {
 		level.Info(a.logger).Log("msg", "No changes necessary")
+		report.NoOp = true
+		return nil
+	}
+
+	if a.dryRun {
+		if patchFile != "" {
+			// only apply the go.mod changes, which are kept in memory, to
+			// include them in the patch file
+			for pos, result := range results {
+				var err error
+				switch r := result.(type) {
+				case *tasks.Result:
+					err = r.ApplyGoMod(resultCtxs[pos])
+				case *goModUpdateResult, *dropReplacesResult:
+					err = r.Apply(resultCtxs[pos])
+				}
+				if err != nil {
+					return errors.Wrap(err, "error previewing go.mod changes")
+				}
+			}
+			goMods := make([]*gomod.GoMod, len(moduleRuns))
+			for pos, mr := range moduleRuns {
+				goMods[pos] = mr.goMod
+			}
+			if err := writePatchFile(ctx, patchFile, goMods, results, true); err != nil {
+				return fmt.Errorf("error writing patch file: %w", err)
+			}
+			level.Info(a.logger).Log("msg", "wrote combined patch file", "path", patchFile)
+		}
+		logDryRun(a.logger, results)
 		return nil
 	}
 
+	// remember the branch to return to, once the run is finished
+	originalBranch, err := gitCurrentBranch(ctx)
+	if err != nil {
+		return gmperr.ErrGit{Op: "rev-parse", Err: err}
+	}
+
 	// test if the git working dir is clean
 	workingDirClean, err := gitIsWorkingDirClean(ctx)
 	if err != nil {
-		return err
+		return gmperr.ErrGit{Op: "status", Err: err}
+	}
+
+	if !workingDirClean && !a.allowDirty {
+		return gmperr.ErrDirtyWorkingDir{}
 	}
 
 	if !workingDirClean {
 		// stash changes including unstaged
 		level.Info(a.logger).Log("msg", "Stashing dirty working directory")
 
-		if err := gitCommand(
+		stashCmd := gitCommand(
 			ctx,
 			"stash",
 			"push",
@@ -251,101 +1170,655 @@ func (a *App) Run(ctx context.Context) error {
 				"[%s] stashed dirty working directory at %s",
 				AppName,
 				time.Now().Format(time.RFC3339),
-			)).Run(); err != nil {
-			return fmt.Errorf("Failed to stash dirty working directory: %w", err)
+			))
+		if err := stashCmd.Run(); err != nil {
+			return gmperr.ErrGitStash{Output: stashCmd.Stderr.String(), Err: err}
 		}
 
-		// stash pop changes including unstaged
+		// restore changes including unstaged, the stash is only dropped once
+		// it has been applied successfully
 		defer func() {
-			if err := gitCommand(ctx, "stash", "pop").Run(); err != nil {
-				level.Error(a.logger).Log("msg", "Failed to restore dirty working directory from stash", "error", err)
-			} else {
-				level.Info(a.logger).Log("msg", "Restored dirty working directory from stash")
+			applyCmd := gitCommand(cleanupCtx, "stash", "apply")
+			if perr := applyCmd.Run(); perr != nil {
+				level.Error(a.logger).Log("msg", "Failed to restore dirty working directory from stash, the stash is preserved", "error", perr)
+				if err == nil {
+					err = gmperr.ErrGitStashPop{Output: applyCmd.Stderr.String(), Err: perr}
+				}
+				return
+			}
+			if perr := gitCommand(cleanupCtx, "stash", "drop").Run(); perr != nil {
+				level.Warn(a.logger).Log("msg", "Failed to drop applied stash", "error", perr)
 			}
+			level.Info(a.logger).Log("msg", "Restored dirty working directory from stash")
 		}()
 	}
 
+	// roll back the working tree, if the run fails before the changes are
+	// committed. This runs before the stash is popped, so only changes of
+	// this run are discarded.
+	committed := false
+	defer func() {
+		if err == nil || committed || !a.cfg.RollbackOnFailure {
+			return
+		}
+		if rerr := gitRollback(cleanupCtx); rerr != nil {
+			level.Error(a.logger).Log("msg", "Failed to roll back working directory", "error", rerr)
+			return
+		}
+		level.Info(a.logger).Log("msg", "Rolled back working directory after failure")
+	}()
+
 	// apply changes from results
-	for _, result := range results {
-		if err := result.Apply(ctx); err != nil {
+	for pos, result := range results {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := result.Apply(resultCtxs[pos])
+		if taskResult, ok := result.(*tasks.Result); ok && resultReports[pos] != nil {
+			applied, rejected := resultReports[pos].addApplied(taskResult, err)
+			a.metrics.PatchesApplied(applied)
+			a.metrics.PatchesRejected(rejected)
+		}
+		if err != nil {
 			if merr, ok := err.(*multierror.Error); ok {
-				for pos, err := range merr.Errors {
+				for _, err := range merr.Errors {
 					level.Warn(a.logger).Log("msg", "error applying result", "pos", pos, "err", err)
+
+					var patchErr *tasks.PatchError
+					if a.cfg.KeepRejects && errors.As(err, &patchErr) {
+						rejectPath := filepath.Join(a.rootPath, rejectFileName(resultReports[pos], pos, patchErr.Patch))
+						if err := ioutil.WriteFile(rejectPath, patchErr.Reject, 0644); err != nil {
+							level.Warn(a.logger).Log("msg", "unable to write rejects file", "path", rejectPath, "err", err)
+						} else {
+							level.Info(a.logger).Log("msg", "wrote rejects file", "path", rejectPath)
+						}
+					}
 				}
 			}
 			return errors.Wrap(err, "error applying changes")
 		}
 	}
 
-	// write go mod
-	if err := goMod.Finish(ctx, a.cfg.VendorDirectory); err != nil {
-		return err
+	// run generators and commands, once the files of all results are in
+	// place
+	for pos, result := range results {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		taskResult, ok := result.(*tasks.Result)
+		if !ok {
+			continue
+		}
+		if err := taskResult.ApplyCommands(resultCtxs[pos]); err != nil {
+			return errors.Wrap(err, "error running commands")
+		}
+	}
+
+	// write go mod of every module
+	goMods := make([]*gomod.GoMod, len(moduleRuns))
+	for pos, mr := range moduleRuns {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := mr.goMod.Finish(mr.ctx, gomod.FinishOptions{
+			Tidy:            a.cfg.TidyModule,
+			Vendor:          a.cfg.VendorDirectory,
+			VerifyCommand:   a.cfg.VerifyCommand,
+			AutoUpdateGoSum: a.cfg.AutoUpdateGoSum,
+		}); err != nil {
+			return err
+		}
+		goMods[pos] = mr.goMod
+
+		changes, err := mr.goMod.IndirectChanges()
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			status := "direct"
+			if change.Indirect {
+				status = "indirect"
+			}
+			level.Info(a.logger).Log("msg", "require changed indirect status", "module", mr.Path, "pkg", change.Path, "version", change.Version.Version, "status", status)
+			report.IndirectChanges = append(report.IndirectChanges, IndirectChange{
+				Module:   mr.Path,
+				Path:     change.Path,
+				Version:  change.Version.Version,
+				Indirect: change.Indirect,
+			})
+		}
+	}
+
+	if patchFile != "" {
+		if err := writePatchFile(ctx, patchFile, goMods, results, false); err != nil {
+			return fmt.Errorf("error writing patch file: %w", err)
+		}
+		level.Info(a.logger).Log("msg", "wrote combined patch file", "path", patchFile)
+	}
+
+	// stage the changes, there is nothing to propose if none are left after
+	// applying the results
+	addCmd := gitCommand(ctx, "add", "-A", ".")
+	if err := addCmd.Run(); err != nil {
+		return gmperr.ErrGit{Op: "add", Output: strings.TrimSpace(addCmd.Stderr.String()), Err: err}
+	}
+	hasChanges, err := gitHasStagedChanges(ctx)
+	if err != nil {
+		return gmperr.ErrGit{Op: "diff", Err: err}
+	}
+	if !hasChanges {
+		level.Info(a.logger).Log("msg", "no changes to commit")
+		report.NoOp = true
+		return nil
 	}
 
 	// create a new branch
-	branchName := fmt.Sprintf(
-		"vendor_go-mod-promote_%s",
-		time.Now().Format("2006-01-02_150405"),
-	)
-	if err := gitCommand(ctx, "checkout", "-b", branchName).Run(); err != nil {
+	branchTemplate, err := a.cfg.branchTemplate()
+	if err != nil {
 		return err
 	}
-
-	// create a git commit with changes
-	if err := gitCommand(ctx, "add", "-A", ".").Run(); err != nil {
+	branchName, err := renderBranchName(ctx, branchTemplate, results, time.Now())
+	if err != nil {
 		return err
 	}
+	branchName, reuse, err := gitAvailableBranchName(ctx, branchName)
+	if err != nil {
+		return gmperr.ErrGit{Op: "branch", Err: err}
+	}
+	// a reused branch is reset to the current HEAD, its previous revision is
+	// restored on failure and used as lease when force pushing
+	checkoutFlag := "-b"
+	var previousRevision string
+	if reuse {
+		previousRevision, err = gitRevision(ctx, "refs/heads/"+branchName)
+		if err != nil {
+			return err
+		}
+		level.Info(a.logger).Log("msg", "reusing existing branch of bot", "branch", branchName, "previous_revision", previousRevision)
+		checkoutFlag = "-B"
+	}
+	checkoutCmd := gitCommand(ctx, "checkout", checkoutFlag, branchName)
+	if err := checkoutCmd.Run(); err != nil {
+		return gmperr.ErrGit{Op: "checkout", Output: strings.TrimSpace(checkoutCmd.Stderr.String()), Err: err}
+	}
+	report.Branch = branchName
+
+	// go back to the original branch, if requested or on failure. On failure
+	// the branch created by this run is removed as well, a reused branch is
+	// reset to its previous revision. This runs before the stash is popped, so
+	// the stashed changes are restored onto the original branch.
+	defer func() {
+		if err == nil && !a.cfg.restoreBranch() {
+			return
+		}
+		if cerr := gitCommand(cleanupCtx, "checkout", originalBranch).Run(); cerr != nil {
+			level.Error(a.logger).Log("msg", "Failed to check out original branch", "branch", originalBranch, "error", cerr)
+			return
+		}
+		level.Info(a.logger).Log("msg", "Checked out original branch", "branch", originalBranch)
+		if err == nil {
+			return
+		}
+		if reuse {
+			if cerr := gitCommand(cleanupCtx, "branch", "-f", branchName, previousRevision).Run(); cerr != nil {
+				level.Error(a.logger).Log("msg", "Failed to reset reused branch", "branch", branchName, "revision", previousRevision, "error", cerr)
+				return
+			}
+			level.Info(a.logger).Log("msg", "Reset reused branch after failure", "branch", branchName, "revision", previousRevision)
+			return
+		}
+		if cerr := gitCommand(cleanupCtx, "branch", "-D", branchName).Run(); cerr != nil {
+			level.Error(a.logger).Log("msg", "Failed to delete branch", "branch", branchName, "error", cerr)
+			return
+		}
+		level.Info(a.logger).Log("msg", "Removed branch after failure", "branch", branchName)
+	}()
 
-	// TODO: Handle no changes
-	if err := gitCommand(ctx, "commit", "--message", "chore: Update vendor", "--author", "Grafanabot go-mod-vendor <bot@grafana.com>", "--allow-empty").Run(); err != nil {
+	// last chance to abort, before the changes are committed
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	// figure out github user
-	gh := github.New(ctx, githubToken)
-	githubUsername, err := gh.Username(ctx)
-	if err != nil {
-		return err
+	// create a git commit with changes, its body lists the version changes
+	commitArgs := []string{"commit", "--message", "chore: Update vendor"}
+	if body := report.commitBody(); body != "" {
+		commitArgs = append(commitArgs, "--message", body)
+	}
+	commitArgs = append(commitArgs, "--author", fmt.Sprintf("%s <%s>", botName, botEmail))
+	if a.cfg.Git.SignCommits {
+		signFlag := "--gpg-sign"
+		if key := a.cfg.Git.SigningKey; key != "" {
+			signFlag += "=" + key
+		}
+		commitArgs = append(commitArgs, signFlag)
 	}
+	commitCmd := gitCommand(ctx, commitArgs...)
+	if err := commitCmd.Run(); err != nil {
+		return gmperr.ErrGit{Op: "commit", Output: strings.TrimSpace(commitCmd.Stderr.String()), Err: err}
+	}
+	committed = true
 
-	// push commit
-	githubURL := &url.URL{
-		Host:   "github.com",
-		Scheme: "https",
-		Path:   fmt.Sprintf("/%s/%s.git", a.cfg.GitHub.Owner, a.cfg.GitHub.Repo),
-		User:   url.UserPassword(githubUsername, githubToken),
+	if a.commitOnly {
+		level.Info(a.logger).Log("msg", "committed changes without pushing", "branch", branchName)
+		return nil
 	}
-	if err := gitCommand(ctx, "push", githubURL.String(), branchName).Run(); err != nil {
-		return err
+
+	owner, repo := a.cfg.GitHub.Owner, a.cfg.GitHub.Repo
+	if remote := a.cfg.Git.Remote; remote != "" && (owner == "" || repo == "") {
+		remoteOwner, remoteRepo, err := gitRemoteRepository(ctx, remote)
+		if err != nil {
+			return err
+		}
+		if owner == "" {
+			owner = remoteOwner
+		}
+		if repo == "" {
+			repo = remoteRepo
+		}
+	}
+
+	// the history of a reused branch has been replaced, it is only
+	// overwritten if it still points to the previous revision
+	pushRefs := []string{branchName}
+	if reuse {
+		pushRefs = []string{fmt.Sprintf("--force-with-lease=refs/heads/%s:%s", branchName, previousRevision), branchName}
+	}
+
+	var pushCmd *command.Cmd
+	if a.cfg.Git.Remote != "" {
+		// push to the remote using the credentials configured for it
+		pushCmd = gitCommand(ctx, append([]string{"push", a.cfg.Git.Remote}, pushRefs...)...)
+	} else {
+		// push commit using the GitHub credentials
+		githubToken, err := gh.Token()
+		if err != nil {
+			return err
+		}
+		githubURL := &url.URL{
+			Host:   "github.com",
+			Scheme: "https",
+			Path:   fmt.Sprintf("/%s/%s.git", owner, repo),
+		}
+		pushCmd = gitPushWithCredentials(ctx, githubURL.String(), githubUsername, githubToken, pushRefs...)
+	}
+	if err := pushCmd.RunWithRetry(retryAttempts, retryBackoff); err != nil {
+		return gmperr.ErrGit{Op: "push", Output: strings.TrimSpace(pushCmd.Stderr.String()), Err: err}
 	}
 
 	// create PR
 	baseBranch := "main"
 	title := fmt.Sprintf("[go-mod-promote] Vendor update %s", strings.Join(packagesUpdated, ", "))
-	_, err = gh.CreatePR(ctx, a.cfg.GitHub.Owner, a.cfg.GitHub.Repo, &github.NewPullRequest{
+	var body string
+	if len(failedPackages) > 0 {
+		body = "The following packages were skipped due to errors:\n\n"
+		for _, failed := range failedPackages {
+			body += fmt.Sprintf("- %s\n", failed)
+		}
+	}
+	pr, err := gh.CreatePR(ctx, owner, repo, &github.NewPullRequest{
 		Base:  &baseBranch,
 		Head:  &branchName,
 		Title: &title,
+		Body:  &body,
+		Draft: &a.cfg.GitHub.Draft,
 	})
+	if err != nil {
+		return gmperr.ErrPullRequest{Owner: owner, Repo: repo, Head: branchName, Err: err}
+	}
+	report.PullRequestURL = pr.GetHTMLURL()
+	a.metrics.PullRequestCreated()
+
+	// labels and reviewers are best-effort, the PR exists already
+	if len(a.cfg.GitHub.Labels) > 0 {
+		if err := gh.AddLabels(ctx, owner, repo, pr.GetNumber(), a.cfg.GitHub.Labels); err != nil {
+			level.Warn(a.logger).Log("msg", "failed to add labels to pull request", "err", err)
+		}
+	}
+	if len(a.cfg.GitHub.Reviewers) > 0 || len(a.cfg.GitHub.TeamReviewers) > 0 {
+		if err := gh.RequestReviewers(ctx, owner, repo, pr.GetNumber(), a.cfg.GitHub.Reviewers, a.cfg.GitHub.TeamReviewers); err != nil {
+			level.Warn(a.logger).Log("msg", "failed to request reviewers for pull request", "err", err)
+		}
+	}
+
+	return nil
+}
+
+// logDryRun logs the changes a run would apply
+func logDryRun(logger logkit.Logger, results []Result) {
+	for _, result := range results {
+		switch r := result.(type) {
+		case *goModUpdateResult:
+			level.Info(logger).Log("msg", "dry-run: would update package", "package", r.pkg, "version", r.version)
+		case *dropReplacesResult:
+			for _, replace := range r.replaces {
+				level.Info(logger).Log("msg", "dry-run: would drop replace", "pkg", replace.Path, "version", replace.Version)
+			}
+		case *tasks.Result:
+			for _, rename := range r.FilesToRename {
+				level.Info(logger).Log("msg", "dry-run: would rename file", "from", rename.From, "to", rename.To)
+			}
+			for _, c := range r.FilesToCopy {
+				if c.Diff != "" {
+					level.Info(logger).Log("msg", "dry-run: would copy file", "source", c.Source, "destination", c.Destination, "diff", c.Diff)
+					continue
+				}
+				level.Info(logger).Log("msg", "dry-run: would copy file", "source", c.Source, "destination", c.Destination)
+			}
+			for _, d := range r.FilesToDelete {
+				level.Info(logger).Log("msg", "dry-run: would delete file", "path", string(d))
+			}
+			for pos, p := range r.Patches {
+				level.Info(logger).Log("msg", "dry-run: would apply patch", "pos", pos, "patch", string(p.Body))
+			}
+			for _, replace := range r.Replaces {
+				level.Info(logger).Log("msg", "dry-run: would add replace", "old", replace.Old.String(), "new", replace.New.String())
+			}
+			for _, require := range r.Requires {
+				level.Info(logger).Log("msg", "dry-run: would update require", "pkg", require.Path, "version", require.Version)
+			}
+			for _, exclude := range r.Excludes {
+				level.Info(logger).Log("msg", "dry-run: would add exclude", "pkg", exclude.Path, "version", exclude.Version)
+			}
+			for _, generate := range r.Generates {
+				level.Info(logger).Log("msg", "dry-run: would run go generate", "dir", generate.Dir, "packages", strings.Join(generate.Packages, " "))
+			}
+			for _, c := range r.Commands {
+				level.Info(logger).Log("msg", "dry-run: would run command", "dir", c.Dir, "command", strings.Join(append([]string{c.Name}, c.Args...), " "))
+			}
+			for _, c := range r.Checks {
+				level.Info(logger).Log("msg", "dry-run: would run check", "dir", c.Dir, "command", strings.Join(append([]string{c.Name}, c.Args...), " "))
+			}
+		}
+	}
+}
+
+func (a *App) newGitHub(ctx context.Context) (*github.GitHub, error) {
+	auth := a.cfg.GitHub.Auth
+	switch auth.Type {
+	case "", "token":
+		githubToken := os.Getenv("GITHUB_TOKEN")
+		if githubToken == "" {
+			return nil, fmt.Errorf("no GitHub token found in environment variable GITHUB_TOKEN")
+		}
+		return github.New(ctx, githubToken), nil
+	case "app":
+		privateKey := []byte(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+		if auth.PrivateKeyPath != "" {
+			var err error
+			privateKey, err = ioutil.ReadFile(auth.PrivateKeyPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(privateKey) == 0 {
+			return nil, fmt.Errorf("no GitHub App private key configured")
+		}
+		return github.NewWithAppAuth(ctx, auth.AppID, auth.InstallationID, privateKey)
+	default:
+		return nil, fmt.Errorf("unknown GitHub auth type '%s'", auth.Type)
+	}
+}
+
+// runPackage downloads the existing and the new version of a package and runs
+// its tasks. It returns nil results, if the package is already up to date.
+func (a *App) runPackage(ctx context.Context, goMod *gomod.GoMod, pkg string, cfg Package, report *PackageReport) ([]Result, error) {
+	modBefore, err := a.downloads.download(ctx, pkg)
+	if err != nil {
+		return nil, err
+	}
+	level.Info(a.logger).Log("msg", "existing package version in go.mod", "package", pkg, "version", modBefore.Version.Release(), "hash", modBefore.Version.Hash())
+	report.VersionBefore = string(modBefore.Version)
+
+	if cfg.RemoteURL == "" {
+		cfg.RemoteURL = pkg
+	}
+
+	ref, isBranch, err := cfg.ref()
+	if err != nil {
+		return nil, gmperr.ErrConfigInvalid{Path: a.configPath, Err: fmt.Errorf("package %s: %w", pkg, err)}
+	}
+	resolved := false
+	if cfg.Track == trackLatestRelease {
+		ref, err = goModLatestRelease(ctx, cfg.RemoteURL)
+		if err != nil {
+			return nil, err
+		}
+		level.Info(a.logger).Log("msg", "found latest release", "package", pkg, "version", ref)
+		if semver.Compare(modBefore.Version.Release(), ref) >= 0 {
+			level.Info(a.logger).Log("msg", "already on latest release nothing to do", "package", pkg)
+			return nil, nil
+		}
+		resolved = true
+	}
+	report.Ref = ref
+	proxyResolvable := isBranch && cfg.ResolveViaProxy
+	if proxyResolvable && module.MatchPrefixPatterns(a.goPrivate(), cfg.RemoteURL) {
+		level.Debug(a.logger).Log("msg", "not resolving private module via module proxy", "package", pkg)
+	} else if proxyResolvable {
+		version, err := proxyResolve(ctx, cfg.RemoteURL, ref)
+		if err != nil {
+			level.Warn(a.logger).Log("msg", "unable to resolve branch via module proxy, falling back to VCS", "package", pkg, "branch", ref, "err", err)
+		} else {
+			if semver.Compare(version, string(modBefore.Version)) < 0 {
+				return nil, fmt.Errorf("module proxy resolved branch %s of %s to %s, which is older than the current version %s", ref, cfg.RemoteURL, version, modBefore.Version)
+			}
+			level.Debug(a.logger).Log("msg", "resolved branch via module proxy", "package", pkg, "branch", ref, "version", version)
+			ref = version
+			resolved = true
+		}
+	}
+
+	// go mod download resolves the ref to the version it currently points
+	// to, the rest of the run only refers to that version, so the revision
+	// can't move during the run
+	modAfter, err := a.downloads.download(ctx, fmt.Sprintf("%s@%s", cfg.RemoteURL, ref))
+	if err != nil {
+		return nil, err
+	}
+	if !resolved {
+		level.Info(a.logger).Log("msg", "resolved ref", "package", pkg, "ref", ref, "version", modAfter.Version, "hash", modAfter.Version.Hash())
+	}
+	level.Info(a.logger).Log("msg", "new package version for go.mod", "package", pkg, "version", modAfter.Version.Release(), "hash", modAfter.Version.Hash())
+	report.VersionAfter = string(modAfter.Version)
+	report.Revision = modAfter.Version.Hash()
+
+	if modBefore.Version == modAfter.Version {
+		level.Info(a.logger).Log("msg", "versions matching nothing to do", "package", pkg)
+		return nil, nil
+	}
+
+	if err := a.checkGoVersion(pkg, modAfter); err != nil {
+		if !a.cfg.GoVersionWarnOnly {
+			return nil, err
+		}
+		level.Warn(a.logger).Log("msg", "ignoring go version mismatch", "package", pkg, "err", err)
+	}
+
+	// scope the package versions into a context only used by this package's
+	// tasks, so they never see the metadata of another package
+	pkgCtx := gmpctx.GoModBeforeIntoContext(ctx, modBefore)
+	pkgCtx = gmpctx.GoModAfterIntoContext(pkgCtx, modAfter)
+	pkgCtx = gmpctx.LoggerIntoContext(pkgCtx, logkit.With(a.logger, "package", pkg))
+
+	var taskResults = make([]*tasks.Result, len(cfg.Tasks))
+	for pos, task := range cfg.Tasks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var err error
+		taskResults[pos], err = task.Run(pkgCtx)
+		if err != nil {
+			return nil, gmperr.ErrTask{Task: task.Name(), Err: err}
+		}
+		report.Tasks = append(report.Tasks, task.Name())
+	}
+	taskResult := tasks.AggregateResult(pkgCtx, taskResults...)
+	if cfg.RequireTaskChanges && taskResult.IsEmpty() {
+		level.Info(a.logger).Log("msg", "tasks produced no changes, skipping version bump", "package", pkg)
+		return nil, nil
+	}
+	report.Updated = true
+	report.addResult(taskResult)
+
+	// pseudo-versions are referred to by their commit hash
+	version := modAfter.Version.Hash()
+	if version == "" {
+		version = string(modAfter.Version)
+	}
+
+	var goVersion string
+	if a.cfg.FollowGoDirective {
+		upstreamGoMod, err := gomod.NewGoModFromPath(modAfter.GoMod)
+		if err != nil {
+			return nil, err
+		}
+		goVersion = upstreamGoMod.GoVersion()
+	}
+
+	return []Result{
+		&goModUpdateResult{
+			goMod:     goMod,
+			pkg:       pkg,
+			remoteURL: cfg.RemoteURL,
+			version:   version,
+			goVersion: goVersion,
+		},
+		taskResult,
+	}, nil
+}
+
+func goVersionToSemver(v string) (string, error) {
+	sv := "v" + strings.TrimPrefix(v, "go")
+	if !semver.IsValid(sv) {
+		return "", fmt.Errorf("invalid go version '%s'", v)
+	}
+	return sv, nil
+}
+
+// checkGoVersion verifies that the go directive of the upstream go.mod is
+// within the configured go version range.
+func (a *App) checkGoVersion(pkg string, mod *api.GoModDownloadResult) error {
+	if a.cfg.MinGoVersion == "" && a.cfg.MaxGoVersion == "" {
+		return nil
+	}
+
+	goMod, err := gomod.NewGoModFromPath(mod.GoMod)
+	if err != nil {
+		return err
+	}
+
+	goVersion := goMod.GoVersion()
+	if goVersion == "" {
+		return nil
+	}
+	version, err := goVersionToSemver(goVersion)
 	if err != nil {
 		return err
 	}
 
+	if a.cfg.MinGoVersion != "" {
+		minVersion, err := goVersionToSemver(a.cfg.MinGoVersion)
+		if err != nil {
+			return err
+		}
+		if semver.Compare(version, minVersion) < 0 {
+			return fmt.Errorf("package %s@%s requires go %s, which is older than min_go_version %s", pkg, mod.Version, goVersion, a.cfg.MinGoVersion)
+		}
+	}
+
+	if a.cfg.MaxGoVersion != "" {
+		maxVersion, err := goVersionToSemver(a.cfg.MaxGoVersion)
+		if err != nil {
+			return err
+		}
+		if semver.Compare(version, maxVersion) > 0 {
+			return fmt.Errorf("package %s@%s requires go %s, which is newer than max_go_version %s", pkg, mod.Version, goVersion, a.cfg.MaxGoVersion)
+		}
+	}
+
 	return nil
 }
 
-func gitIsWorkingDirClean(ctx context.Context) (bool, error) {
-	cmd := gitCommand(ctx, "status", "--porcelain")
-	if err := cmd.Run(); err != nil {
-		return false, err
+// patchFilePath resolves the configured patch file relative to the root path.
+// It must not be inside the git work tree, as it would be committed otherwise.
+func (a *App) patchFilePath(ctx context.Context) (string, error) {
+	path := a.cfg.PatchFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(a.rootPath, path)
+	}
+
+	workTree, err := gitWorkTree(ctx)
+	if err != nil {
+		return "", err
+	}
+	checkPath := path
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+		checkPath = filepath.Join(dir, filepath.Base(path))
+	}
+	if resolved, err := filepath.EvalSymlinks(workTree); err == nil {
+		workTree = resolved
 	}
-	if len(cmd.Stdout.String()) > 0 {
-		return false, nil
+	if rel, err := filepath.Rel(workTree, checkPath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", gmperr.ErrConfigInvalid{Path: a.configPath, Err: fmt.Errorf("patch_file '%s' is inside the git work tree '%s'", a.cfg.PatchFile, workTree)}
 	}
+	return path, nil
+}
 
-	return true, nil
+// rejectFileName names the rejects file of a patch after the package and
+// the position of the patch, so rejects of different patches don't
+// overwrite each other.
+func rejectFileName(pkgReport *PackageReport, result, patch int) string {
+	name := "aggregate"
+	if pkgReport != nil {
+		name = strings.ReplaceAll(pkgReport.Name, "/", "_")
+	}
+	return fmt.Sprintf("%s-%s-%d-%d.rej", AppName, name, result, patch)
 }
 
-func gitCommand(ctx context.Context, args ...string) *command.Cmd {
-	return command.New(ctx, "git", args...)
+// writePatchFile combines the patches of all results and the go.mod diff into
+// a single patch file. If preview is set, the go.mod diff is computed without
+// writing go.mod.
+func writePatchFile(ctx context.Context, path string, goMods []*gomod.GoMod, results []Result, preview bool) error {
+	var patch []byte
+	addPatch := func(body []byte) {
+		if len(body) == 0 {
+			return
+		}
+		patch = append(patch, body...)
+		if body[len(body)-1] != '\n' {
+			patch = append(patch, '\n')
+		}
+	}
+
+	for _, result := range results {
+		taskResult, ok := result.(*tasks.Result)
+		if !ok {
+			continue
+		}
+		for _, p := range taskResult.Patches {
+			addPatch(p.Body)
+		}
+	}
+
+	rootPath, err := gmpctx.RootPathFromContextOrError(ctx)
+	if err != nil {
+		return err
+	}
+	for _, goMod := range goMods {
+		name, err := filepath.Rel(rootPath, goMod.Path())
+		if err != nil {
+			return err
+		}
+		diff := goMod.Diff
+		if preview {
+			diff = goMod.PreviewDiff
+		}
+		goModDiff, err := diff(ctx, filepath.ToSlash(name))
+		if err != nil {
+			return err
+		}
+		addPatch(goModDiff)
+	}
+
+	return ioutil.WriteFile(path, patch, 0644)
 }
@@ -0,0 +1,708 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+	"github.com/grafana/go-mod-promote/pkg/gomod"
+	"github.com/grafana/go-mod-promote/pkg/tasks"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// gitRepo creates a git repository with the given files committed.
+func gitRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		writeFile(t, filepath.Join(dir, name), content)
+	}
+	git(t, dir, "init", "-q")
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "initial")
+	return dir
+}
+
+// setEnv sets an environment variable for the duration of the test.
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// fakeModule writes the go.mod of an upstream module and returns its
+// download result.
+func fakeModule(t *testing.T, path string, version api.GoModVersion, goVersion string) *api.GoModDownloadResult {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "mod")
+	writeFile(t, filepath.Join(dir, "go.mod"), "module "+path+"\n\ngo "+goVersion+"\n")
+	return &api.GoModDownloadResult{
+		GoMod:   filepath.Join(dir, "go.mod"),
+		Path:    path,
+		Version: version,
+		Dir:     dir,
+	}
+}
+
+func TestCheckGoVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		min, max  string
+		goVersion string
+		wantErr   bool
+	}{
+		{name: "no range", goVersion: "1.16"},
+		{name: "within range", min: "1.14", max: "1.16", goVersion: "1.15"},
+		{name: "equal to min", min: "1.15", goVersion: "1.15"},
+		{name: "equal to max", max: "1.15", goVersion: "1.15"},
+		{name: "older than min", min: "1.15", goVersion: "1.14", wantErr: true},
+		{name: "newer than max", max: "1.15", goVersion: "1.16", wantErr: true},
+		{name: "patch release newer than max", max: "1.16", goVersion: "1.16.3", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newApp(nil)
+			a.cfg = &Config{MinGoVersion: tc.min, MaxGoVersion: tc.max}
+
+			err := a.checkGoVersion("example.com/pkg", fakeModule(t, "example.com/pkg", "v1.0.0", tc.goVersion))
+			if tc.wantErr && err == nil {
+				t.Fatal("expected an error")
+			} else if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunPackageSkipsGoVersionOfUnchangedPackage(t *testing.T) {
+	mod := fakeModule(t, "example.com/pkg", "v1.0.0", "1.99")
+
+	a := newApp([]Option{WithModDownloader(ModDownloaderFunc(func(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
+		return mod, nil
+	}))})
+	a.cfg = &Config{MaxGoVersion: "1.15"}
+	a.downloads = newDownloadCache(a.downloader)
+
+	ctx := gmpctx.ModulePathIntoContext(context.Background(), t.TempDir())
+	results, err := a.runPackage(ctx, nil, "example.com/pkg", Package{Tag: "v1.0.0"}, &PackageReport{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results != nil {
+		t.Fatalf("expected no results for an unchanged package, got %v", results)
+	}
+}
+
+const testGoMod = `module example.com/app
+
+go 1.15
+
+require example.com/pkg v1.0.0
+`
+
+func TestWritePatchFileApplies(t *testing.T) {
+	rootPath := gitRepo(t, map[string]string{
+		"go.mod":    testGoMod,
+		"hello.txt": "hello\n",
+	})
+	ctx := gmpctx.RootPathIntoContext(context.Background(), rootPath)
+
+	goMod, err := gomod.NewGoModFromDir(ctx, rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goMod.UpdatePackage("example.com/pkg", "v1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	results := []Result{&tasks.Result{Patches: []tasks.Patch{{Body: []byte(`--- a/hello.txt
++++ b/hello.txt
+@@ -1 +1 @@
+-hello
++hello world
+`)}}}}
+
+	patchFile := filepath.Join(t.TempDir(), "combined.patch")
+	if err := writePatchFile(ctx, patchFile, []*gomod.GoMod{goMod}, results, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the preview must not touch go.mod
+	data, err := ioutil.ReadFile(filepath.Join(rootPath, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testGoMod {
+		t.Fatalf("go.mod was modified by the preview:\n%s", data)
+	}
+
+	git(t, rootPath, "apply", patchFile)
+
+	data, err = ioutil.ReadFile(filepath.Join(rootPath, "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world\n" {
+		t.Errorf("unexpected content of hello.txt after applying the patch: %q", data)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(rootPath, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("example.com/pkg v1.1.0")) {
+		t.Errorf("go.mod doesn't require the updated version after applying the patch:\n%s", data)
+	}
+}
+
+func TestPatchFilePath(t *testing.T) {
+	// directories of t.TempDir are siblings, so the relative path of outside
+	// starts with ..
+	rootPath := gitRepo(t, map[string]string{"go.mod": testGoMod})
+	outside := filepath.Join(t.TempDir(), "combined.patch")
+
+	for _, tc := range []struct {
+		name      string
+		patchFile string
+		want      string
+		wantErr   bool
+	}{
+		{name: "absolute outside of the work tree", patchFile: outside, want: outside},
+		{name: "relative outside of the work tree", patchFile: filepath.Join("..", filepath.Base(filepath.Dir(outside)), "combined.patch"), want: outside},
+		{name: "relative inside of the work tree", patchFile: "combined.patch", wantErr: true},
+		{name: "absolute inside of the work tree", patchFile: filepath.Join(rootPath, "sub", "combined.patch"), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newApp(nil)
+			a.rootPath = rootPath
+			a.cfg = &Config{PatchFile: tc.patchFile}
+
+			path, err := a.patchFilePath(a.ctx(context.Background()))
+			if tc.wantErr {
+				var cfgErr gmperr.ErrConfigInvalid
+				if !errors.As(err, &cfgErr) {
+					t.Fatalf("expected ErrConfigInvalid, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if path != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, path)
+			}
+		})
+	}
+}
+
+// fakeDownloader serves the download results by path, a path without version
+// refers to the version in go.mod.
+func fakeDownloader(results map[string]*api.GoModDownloadResult) ModDownloader {
+	return ModDownloaderFunc(func(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
+		result, ok := results[path]
+		if !ok {
+			return nil, gmperr.ErrGoModDownload{Path: path, Err: errors.New("not found")}
+		}
+		return result, nil
+	})
+}
+
+func TestRunPackageScopesModulesPerPackage(t *testing.T) {
+	rootPath := t.TempDir()
+	packages := []string{"example.com/a", "example.com/b", "example.com/c", "example.com/d"}
+
+	downloads := make(map[string]*api.GoModDownloadResult)
+	for _, pkg := range packages {
+		downloads[pkg] = fakeModule(t, pkg, "v1.0.0", "1.15")
+		after := fakeModule(t, pkg, "v1.1.0", "1.15")
+		writeFile(t, filepath.Join(after.Dir, "file.txt"), pkg)
+		downloads[pkg+"@v1.1.0"] = after
+		writeFile(t, filepath.Join(rootPath, "vendor", pkg, "file.txt"), "outdated")
+	}
+
+	a := newApp([]Option{WithModDownloader(fakeDownloader(downloads))})
+	a.cfg = &Config{}
+	a.rootPath = rootPath
+	a.downloads = newDownloadCache(a.downloader)
+	ctx := gmpctx.ModulePathIntoContext(a.ctx(context.Background()), rootPath)
+
+	results := make([][]Result, len(packages))
+	errs := make([]error, len(packages))
+	var wg sync.WaitGroup
+	for pos, pkg := range packages {
+		wg.Add(1)
+		go func(pos int, pkg string) {
+			defer wg.Done()
+			cfg := Package{Tag: "v1.1.0", Tasks: []tasks.Task{{SyncDirectory: &tasks.TaskSyncDirectory{
+				Source:      ".",
+				Destination: filepath.Join("vendor", pkg),
+				Glob:        "*.txt",
+			}}}}
+			results[pos], errs[pos] = a.runPackage(ctx, nil, pkg, cfg, &PackageReport{Name: pkg})
+		}(pos, pkg)
+	}
+	wg.Wait()
+
+	for pos, pkg := range packages {
+		if errs[pos] != nil {
+			t.Fatalf("unexpected error for %s: %v", pkg, errs[pos])
+		}
+		var copies []tasks.Copy
+		for _, r := range results[pos] {
+			if taskResult, ok := r.(*tasks.Result); ok {
+				copies = append(copies, taskResult.FilesToCopy...)
+			}
+		}
+		if len(copies) != 1 {
+			t.Fatalf("expected a single copy for %s, got %v", pkg, copies)
+		}
+		if want := filepath.Join(downloads[pkg+"@v1.1.0"].Dir, "file.txt"); copies[0].Source != want {
+			t.Errorf("%s copies from %s, expected %s", pkg, copies[0].Source, want)
+		}
+	}
+}
+
+func TestRunWithoutPackages(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		strict bool
+	}{
+		{name: "warn"},
+		{name: "strict", strict: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewWithConfig(&Config{Strict: tc.strict}, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := a.RunWithResult(context.Background())
+			if tc.strict {
+				var cfgErr gmperr.ErrConfigInvalid
+				if !errors.As(err, &cfgErr) {
+					t.Fatalf("expected ErrConfigInvalid, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !report.NoOp {
+				t.Error("expected the run to be a no-op")
+			}
+		})
+	}
+}
+
+func TestRunFailsWithoutGitHubToken(t *testing.T) {
+	setEnv(t, "GITHUB_TOKEN", "")
+
+	downloader := ModDownloaderFunc(func(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
+		t.Errorf("unexpected download of %s before verifying the GitHub token", path)
+		return nil, errors.New("unexpected download")
+	})
+	a, err := NewWithConfig(&Config{
+		Packages: map[string]Package{"example.com/pkg": {Branch: "main"}},
+	}, gitRepo(t, map[string]string{"go.mod": testGoMod}), WithModDownloader(downloader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.RunWithResult(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "GITHUB_TOKEN") {
+		t.Fatalf("expected an error about the missing GitHub token, got %v", err)
+	}
+}
+
+func TestRunWithoutChangesToCommit(t *testing.T) {
+	// the repository already requires the new version, so applying the
+	// update leaves the working tree unchanged
+	rootPath := gitRepo(t, map[string]string{"go.mod": strings.Replace(testGoMod, "v1.0.0", "v1.1.0", 1)})
+	head := git(t, rootPath, "rev-parse", "HEAD")
+
+	a, err := NewWithConfig(&Config{
+		Packages:      map[string]Package{"example.com/pkg": {Branch: "main"}},
+		VerifyCommand: []string{"true"},
+	}, rootPath, WithCommitOnly(true), WithModDownloader(fakeDownloader(map[string]*api.GoModDownloadResult{
+		"example.com/pkg":      fakeModule(t, "example.com/pkg", "v1.0.0", "1.15"),
+		"example.com/pkg@main": fakeModule(t, "example.com/pkg", "v1.1.0", "1.15"),
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := a.RunWithResult(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.NoOp {
+		t.Error("expected the run to be a no-op")
+	}
+	if got := git(t, rootPath, "rev-parse", "HEAD"); got != head {
+		t.Errorf("expected no commit, HEAD moved from %s to %s", head, got)
+	}
+	if branches := strings.TrimSpace(git(t, rootPath, "branch", "--format=%(refname:short)")); strings.Contains(branches, "\n") {
+		t.Errorf("expected no branch to be created, got:\n%s", branches)
+	}
+}
+
+// fileProxy sets up a module proxy serving the given versions, keyed by
+// module path.
+func fileProxy(t *testing.T, versions map[string][]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for path, list := range versions {
+		writeFile(t, filepath.Join(dir, path, "@v", "list"), strings.Join(list, "\n")+"\n")
+		for _, version := range list {
+			writeFile(t, filepath.Join(dir, path, "@v", version+".info"), `{"Version":"`+version+`","Time":"2021-01-01T00:00:00Z"}`)
+			writeFile(t, filepath.Join(dir, path, "@v", version+".mod"), "module "+path+"\n")
+		}
+	}
+	setEnv(t, "GOPROXY", "file://"+filepath.ToSlash(dir))
+	setEnv(t, "GOSUMDB", "off")
+	setEnv(t, "GOFLAGS", "")
+	setEnv(t, "GONOPROXY", "")
+	setEnv(t, "GOPRIVATE", "")
+}
+
+func TestPackageRef(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		pkg          Package
+		wantRef      string
+		wantIsBranch bool
+		wantErr      bool
+	}{
+		{name: "default", wantRef: "master", wantIsBranch: true},
+		{name: "branch", pkg: Package{Branch: "main"}, wantRef: "main", wantIsBranch: true},
+		{name: "tag", pkg: Package{Tag: "v1.0.0"}, wantRef: "v1.0.0"},
+		{name: "commit", pkg: Package{Commit: "abcdef"}, wantRef: "abcdef"},
+		{name: "branch and tag", pkg: Package{Branch: "main", Tag: "v1.0.0"}, wantErr: true},
+		{name: "track branch", pkg: Package{Track: "branch", Branch: "main"}, wantRef: "main", wantIsBranch: true},
+		{name: "track latest release", pkg: Package{Track: "latest_release"}},
+		{name: "track latest release with tag", pkg: Package{Track: "latest_release", Tag: "v1.0.0"}, wantErr: true},
+		{name: "unknown track", pkg: Package{Track: "nightly"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, isBranch, err := tc.pkg.ref()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ref != tc.wantRef || isBranch != tc.wantIsBranch {
+				t.Errorf("expected %q (branch=%v), got %q (branch=%v)", tc.wantRef, tc.wantIsBranch, ref, isBranch)
+			}
+		})
+	}
+}
+
+func TestGoModLatestRelease(t *testing.T) {
+	fileProxy(t, map[string][]string{
+		"example.com/pkg":        {"v0.9.0", "v1.1.0", "v1.2.0-rc.1", "v1.0.0"},
+		"example.com/prerelease": {"v1.0.0-rc.1"},
+	})
+	rootPath := t.TempDir()
+	writeFile(t, filepath.Join(rootPath, "go.mod"), "module example.com/app\n\ngo 1.15\n")
+	ctx := gmpctx.ModulePathIntoContext(context.Background(), rootPath)
+
+	latest, err := goModLatestRelease(ctx, "example.com/pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != "v1.1.0" {
+		t.Errorf("expected v1.1.0, got %s", latest)
+	}
+
+	if latest, err := goModLatestRelease(ctx, "example.com/prerelease"); err == nil {
+		t.Errorf("expected an error for a module without releases, got %s", latest)
+	}
+}
+
+func TestRunPackageOnLatestRelease(t *testing.T) {
+	fileProxy(t, map[string][]string{
+		"example.com/pkg": {"v1.0.0", "v1.1.0"},
+	})
+	rootPath := t.TempDir()
+	writeFile(t, filepath.Join(rootPath, "go.mod"), "module example.com/app\n\ngo 1.15\n")
+
+	a := newApp([]Option{WithModDownloader(fakeDownloader(map[string]*api.GoModDownloadResult{
+		"example.com/pkg": fakeModule(t, "example.com/pkg", "v1.1.0", "1.15"),
+	}))})
+	a.cfg = &Config{}
+	a.downloads = newDownloadCache(a.downloader)
+
+	ctx := gmpctx.ModulePathIntoContext(context.Background(), rootPath)
+	report := &PackageReport{}
+	results, err := a.runPackage(ctx, nil, "example.com/pkg", Package{Track: "latest_release"}, report)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results != nil {
+		t.Errorf("expected no results for a package on the latest release, got %v", results)
+	}
+}
+
+func TestNewWithConfig(t *testing.T) {
+	rootPath := t.TempDir()
+	writeFile(t, filepath.Join(rootPath, "file"), "")
+
+	for _, tc := range []struct {
+		name     string
+		cfg      *Config
+		rootPath string
+		opts     []Option
+		wantErr  bool
+	}{
+		{name: "valid", cfg: &Config{}, rootPath: rootPath},
+		{name: "nil config", rootPath: rootPath, wantErr: true},
+		{name: "missing root path", cfg: &Config{}, rootPath: filepath.Join(rootPath, "missing"), wantErr: true},
+		{name: "root path is a file", cfg: &Config{}, rootPath: filepath.Join(rootPath, "file"), wantErr: true},
+		{name: "invalid branch template", cfg: &Config{BranchTemplate: "{{ .Unknown"}, rootPath: rootPath, wantErr: true},
+		{name: "unknown package filter", cfg: &Config{}, rootPath: rootPath, opts: []Option{WithPackageFilter([]string{"example.com/unknown"})}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewWithConfig(tc.cfg, tc.rootPath, tc.opts...)
+			if tc.wantErr {
+				var cfgErr gmperr.ErrConfigInvalid
+				if !errors.As(err, &cfgErr) {
+					t.Fatalf("expected ErrConfigInvalid, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if a.rootPath != tc.rootPath {
+				t.Errorf("expected root path %s, got %s", tc.rootPath, a.rootPath)
+			}
+		})
+	}
+}
+
+func TestNewWithConfigDoesNotModifyConfig(t *testing.T) {
+	cfg := &Config{
+		Packages: map[string]Package{"example.com/a": {}, "example.com/b": {}},
+		Modules: []Module{{
+			Path:     "sub",
+			Packages: map[string]Package{"example.com/c": {}},
+		}},
+	}
+
+	a, err := NewWithConfig(cfg, t.TempDir(), WithPackageFilter([]string{"example.com/a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.cfg.Packages) != 1 || len(a.cfg.Modules[0].Packages) != 0 {
+		t.Errorf("expected the packages of the app to be filtered, got %v and %v", a.cfg.Packages, a.cfg.Modules[0].Packages)
+	}
+	if len(cfg.Packages) != 2 || len(cfg.Modules[0].Packages) != 1 {
+		t.Errorf("the config passed in has been modified: %v and %v", cfg.Packages, cfg.Modules[0].Packages)
+	}
+}
+
+func TestRunWithFakeDownloader(t *testing.T) {
+	rootPath := gitRepo(t, map[string]string{
+		"go.mod":                           testGoMod,
+		"vendor/example.com/pkg/file.txt":  "old\n",
+		"vendor/example.com/pkg/local.txt": "local\n",
+	})
+	git(t, rootPath, "config", "user.name", "test")
+	git(t, rootPath, "config", "user.email", "test@example.com")
+
+	after := fakeModule(t, "example.com/pkg", "v1.1.0", "1.15")
+	writeFile(t, filepath.Join(after.Dir, "file.txt"), "new\n")
+	var downloads []string
+	downloader := fakeDownloader(map[string]*api.GoModDownloadResult{
+		"example.com/pkg":      fakeModule(t, "example.com/pkg", "v1.0.0", "1.15"),
+		"example.com/pkg@main": after,
+	})
+
+	a, err := NewWithConfig(&Config{
+		Packages: map[string]Package{"example.com/pkg": {
+			Branch: "main",
+			Tasks: []tasks.Task{{SyncDirectory: &tasks.TaskSyncDirectory{
+				Source:      ".",
+				Destination: "vendor/example.com/pkg",
+				Exclude:     []string{"go.mod"},
+			}}},
+		}},
+		VerifyCommand: []string{"true"},
+	}, rootPath, WithCommitOnly(true), WithModDownloader(ModDownloaderFunc(func(ctx context.Context, path string) (*api.GoModDownloadResult, error) {
+		downloads = append(downloads, path)
+		return downloader.Download(ctx, path)
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := a.RunWithResult(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.NoOp || report.Branch == "" {
+		t.Fatalf("expected a branch to be committed, got %+v", report)
+	}
+	if got := strings.Join(downloads, ","); got != "example.com/pkg,example.com/pkg@main" {
+		t.Errorf("unexpected downloads %s", got)
+	}
+	if pkg := report.Packages[0]; pkg.VersionBefore != "v1.0.0" || pkg.VersionAfter != "v1.1.0" {
+		t.Errorf("unexpected versions in report %+v", pkg)
+	}
+
+	for name, want := range map[string]string{
+		"go.mod":                          strings.Replace(testGoMod, "v1.0.0", "v1.1.0", 1),
+		"vendor/example.com/pkg/file.txt": "new\n",
+	} {
+		if got := git(t, rootPath, "show", report.Branch+":"+name); got != want {
+			t.Errorf("unexpected content of %s on %s: %q", name, report.Branch, got)
+		}
+	}
+	if files := git(t, rootPath, "ls-tree", "-r", "--name-only", report.Branch); strings.Contains(files, "local.txt") {
+		t.Errorf("expected the extraneous file to be deleted, got:\n%s", files)
+	}
+}
+
+func TestRunFailureRestoresWorkTree(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// prepare sets up the failure of the run
+		prepare     func(t *testing.T, rootPath string, before, after *api.GoModDownloadResult)
+		task        tasks.Task
+		wantRejects int
+	}{
+		{
+			name: "commit fails after checkout",
+			prepare: func(t *testing.T, rootPath string, before, after *api.GoModDownloadResult) {
+				writeFile(t, filepath.Join(after.Dir, "file.txt"), "new\n")
+				hook := filepath.Join(rootPath, ".git", "hooks", "pre-commit")
+				writeFile(t, hook, "#!/bin/sh\nexit 1\n")
+				if err := os.Chmod(hook, 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			task: tasks.Task{SyncDirectory: &tasks.TaskSyncDirectory{
+				Source:      ".",
+				Destination: "vendor/example.com/pkg",
+				Exclude:     []string{"go.mod"},
+			}},
+		},
+		{
+			name: "patch rejected",
+			prepare: func(t *testing.T, rootPath string, before, after *api.GoModDownloadResult) {
+				writeFile(t, filepath.Join(before.Dir, "file.txt"), "one\ntwo\nthree\n")
+				writeFile(t, filepath.Join(after.Dir, "file.txt"), "one\nTWO\nthree\n")
+			},
+			task: tasks.Task{Diff: &tasks.TaskDiff{
+				Source:      ".",
+				Destination: "vendor/example.com/pkg",
+			}},
+			wantRejects: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rootPath := gitRepo(t, map[string]string{
+				"go.mod":                          testGoMod,
+				"vendor/example.com/pkg/file.txt": "old\n",
+			})
+			git(t, rootPath, "config", "user.name", "test")
+			git(t, rootPath, "config", "user.email", "test@example.com")
+			originalBranch := strings.TrimSpace(git(t, rootPath, "rev-parse", "--abbrev-ref", "HEAD"))
+
+			before := fakeModule(t, "example.com/pkg", "v1.0.0", "1.15")
+			after := fakeModule(t, "example.com/pkg", "v1.1.0", "1.15")
+			tc.prepare(t, rootPath, before, after)
+
+			a, err := NewWithConfig(&Config{
+				Packages: map[string]Package{"example.com/pkg": {
+					Branch: "main",
+					Tasks:  []tasks.Task{tc.task},
+				}},
+				VerifyCommand:     []string{"true"},
+				KeepRejects:       true,
+				RollbackOnFailure: true,
+			}, rootPath, WithCommitOnly(true), WithModDownloader(fakeDownloader(map[string]*api.GoModDownloadResult{
+				"example.com/pkg":      before,
+				"example.com/pkg@main": after,
+			})))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := a.RunWithResult(context.Background()); err == nil {
+				t.Fatal("expected the run to fail")
+			}
+
+			if got := strings.TrimSpace(git(t, rootPath, "rev-parse", "--abbrev-ref", "HEAD")); got != originalBranch {
+				t.Errorf("expected the original branch %s to be checked out, got %s", originalBranch, got)
+			}
+			if branches := strings.TrimSpace(git(t, rootPath, "branch", "--list", "vendor_go-mod-promote_*")); branches != "" {
+				t.Errorf("expected the branch of the run to be deleted, got %s", branches)
+			}
+
+			// only the reject files are left behind
+			var rejects int
+			for _, line := range strings.Split(strings.TrimSpace(git(t, rootPath, "status", "--porcelain", "--untracked-files=all")), "\n") {
+				switch {
+				case line == "":
+				case strings.HasPrefix(line, "?? "+AppName+"-") && strings.HasSuffix(line, ".rej"):
+					rejects++
+				default:
+					t.Errorf("expected a clean work tree, got %q", line)
+				}
+			}
+			if rejects != tc.wantRejects {
+				t.Errorf("expected %d reject files, got %d", tc.wantRejects, rejects)
+			}
+			if got, _ := ioutil.ReadFile(filepath.Join(rootPath, "go.mod")); string(got) != testGoMod {
+				t.Errorf("expected go.mod to be rolled back, got:\n%s", got)
+			}
+		})
+	}
+}
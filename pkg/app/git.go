@@ -0,0 +1,299 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/grafana/go-mod-promote/pkg/command"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+func gitIsWorkingDirClean(ctx context.Context) (bool, error) {
+	cmd := gitCommand(ctx, "status", "--porcelain")
+	if err := cmd.Run(); err != nil {
+		return false, err
+	}
+	if len(cmd.Stdout.String()) > 0 {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// gitHasStagedChanges returns true, if the index differs from HEAD.
+func gitHasStagedChanges(ctx context.Context) (bool, error) {
+	cmd := gitCommand(ctx, "diff", "--cached", "--quiet")
+	if err := cmd.Run(); err != nil {
+		if cmd.ExitCode == 1 {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// gitRevision returns the commit hash the ref points to.
+func gitRevision(ctx context.Context, ref string) (string, error) {
+	cmd := gitCommand(ctx, "rev-parse", "--verify", ref+"^{commit}")
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error resolving %s (%s): %w", ref, strings.TrimSpace(cmd.Stderr.String()), err)
+	}
+	return strings.TrimSpace(cmd.Stdout.String()), nil
+}
+
+// gitCurrentBranch returns the name of the checked out branch, or the commit
+// hash if HEAD is detached.
+func gitCurrentBranch(ctx context.Context) (string, error) {
+	cmd := gitCommand(ctx, "rev-parse", "--abbrev-ref", "HEAD")
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	if branch := strings.TrimSpace(cmd.Stdout.String()); branch != "HEAD" {
+		return branch, nil
+	}
+
+	cmd = gitCommand(ctx, "rev-parse", "HEAD")
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(cmd.Stdout.String()), nil
+}
+
+// gitRollback discards all changes to tracked files and removes untracked
+// files, except for reject files.
+func gitRollback(ctx context.Context) error {
+	if err := gitCommand(ctx, "reset", "--hard", "HEAD").Run(); err != nil {
+		return err
+	}
+	return gitCommand(ctx, "clean", "-fd", "-e", AppName+"-*.rej").Run()
+}
+
+// gitRemoteRepository returns the GitHub owner and repository of the remote's
+// URL.
+func gitRemoteRepository(ctx context.Context, remote string) (string, string, error) {
+	cmd := gitCommand(ctx, "remote", "get-url", remote)
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("error getting url of remote '%s': %w stderr=[%s]", remote, err, cmd.Stderr.String())
+	}
+	remoteURL := strings.TrimSpace(cmd.Stdout.String())
+
+	// scp-like syntax, e.g. git@github.com:owner/repo.git
+	path := remoteURL
+	if u, err := url.Parse(remoteURL); err == nil && u.Scheme != "" {
+		path = u.Path
+	} else if pos := strings.Index(remoteURL, ":"); pos >= 0 {
+		path = remoteURL[pos+1:]
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimSuffix(path, ".git"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("unable to derive owner and repository from url '%s' of remote '%s'", remoteURL, remote)
+	}
+	return parts[0], parts[1], nil
+}
+
+// gitWorkTree returns the top level directory of the work tree.
+func gitWorkTree(ctx context.Context) (string, error) {
+	cmd := gitCommand(ctx, "rev-parse", "--show-toplevel")
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error finding git work tree (%s): %w", strings.TrimSpace(cmd.Stderr.String()), err)
+	}
+	return filepath.Clean(strings.TrimSpace(cmd.Stdout.String())), nil
+}
+
+func gitCommand(ctx context.Context, args ...string) *command.Cmd {
+	rootPath, _ := gmpctx.RootPathFromContextOrError(ctx)
+	return command.New(ctx, "git", args...).WithDir(rootPath)
+}
+
+// gitPushWithCredentials returns the command pushing refs to remoteURL. The
+// credentials are passed through the environment to a credential helper, so
+// they never show up in the arguments or the logs.
+func gitPushWithCredentials(ctx context.Context, remoteURL, username, password string, refs ...string) *command.Cmd {
+	args := append([]string{
+		"-c", "credential.helper=",
+		"-c", `credential.helper=!f() { echo "username=${GMP_GIT_USERNAME}"; echo "password=${GMP_GIT_PASSWORD}"; }; f`,
+		"push", remoteURL,
+	}, refs...)
+	return gitCommand(ctx, args...).WithRedaction(password).WithEnv(map[string]string{
+		"GMP_GIT_USERNAME": username,
+		"GMP_GIT_PASSWORD": password,
+	})
+}
+
+// branchTemplateData is available to the branch_template.
+type branchTemplateData struct {
+	Timestamp string
+	Packages  []string
+	Hash      string // derived from the updated packages and versions
+}
+
+var branchTemplateFuncs = template.FuncMap{
+	"join":    strings.Join,
+	"base":    path.Base,
+	"lower":   strings.ToLower,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+}
+
+// renderBranchName renders the branch name for the packages and versions
+// updated by the results and verifies it is a valid git branch name.
+func renderBranchName(ctx context.Context, tmpl *template.Template, results []Result, now time.Time) (string, error) {
+	data := branchTemplateData{
+		Timestamp: now.Format("2006-01-02_150405"),
+	}
+	var updates []string
+	for _, result := range results {
+		if r, ok := result.(*goModUpdateResult); ok {
+			data.Packages = append(data.Packages, r.pkg)
+			updates = append(updates, fmt.Sprintf("%s@%s", r.pkg, r.version))
+		}
+	}
+	sort.Strings(data.Packages)
+	sort.Strings(updates)
+
+	h := sha256.Sum256([]byte(strings.Join(updates, "\n")))
+	data.Hash = fmt.Sprintf("%x", h[:6])
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error rendering branch_template: %w", err)
+	}
+	name := strings.TrimSpace(b.String())
+
+	if err := gitCommand(ctx, "check-ref-format", "refs/heads/"+name).Run(); err != nil {
+		return "", fmt.Errorf("branch name '%s' rendered from branch_template is not a valid git ref", name)
+	}
+	return name, nil
+}
+
+// gitConfig returns the value of a git config key, it is empty if unset.
+func gitConfig(ctx context.Context, key string) (string, error) {
+	cmd := gitCommand(ctx, "config", "--get", key)
+	if err := cmd.Run(); err != nil {
+		if cmd.ExitCode == 1 {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(cmd.Stdout.String()), nil
+}
+
+// gitVerifySigningKey checks, that git is able to sign commits with the given
+// key or the one from the git config.
+func gitVerifySigningKey(ctx context.Context, key string) error {
+	if key == "" {
+		var err error
+		if key, err = gitConfig(ctx, "user.signingkey"); err != nil {
+			return err
+		}
+	}
+	format, err := gitConfig(ctx, "gpg.format")
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "", "openpgp":
+		if key == "" {
+			// git falls back to the committer's email address
+			if key, err = gitConfig(ctx, "user.email"); err != nil {
+				return err
+			}
+			if key == "" {
+				return fmt.Errorf("no signing key is configured, set git.signing_key or user.signingKey")
+			}
+		}
+		program, err := gitConfig(ctx, "gpg.program")
+		if err != nil {
+			return err
+		}
+		if program == "" {
+			program = "gpg"
+		}
+		if err := command.New(ctx, program, "--list-secret-keys", key).Run(); err != nil {
+			return fmt.Errorf("no secret key for '%s' is available to %s: %w", key, program, err)
+		}
+	case "ssh":
+		if key == "" {
+			return fmt.Errorf("no signing key is configured, set git.signing_key or user.signingKey")
+		}
+		if strings.HasPrefix(key, "key::") || strings.HasPrefix(key, "ssh-") {
+			// literal public key, the private key is held by the ssh-agent
+			return nil
+		}
+		if _, err := os.Stat(expandHome(key)); err != nil {
+			return fmt.Errorf("ssh signing key is not available: %w", err)
+		}
+	default:
+		if key == "" {
+			return fmt.Errorf("no signing key is configured, set git.signing_key or user.signingKey")
+		}
+	}
+	return nil
+}
+
+// expandHome replaces a leading ~/ with the home directory.
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[2:])
+}
+
+func gitBranchExists(ctx context.Context, name string) (bool, error) {
+	cmd := gitCommand(ctx, "rev-parse", "--verify", "--quiet", "refs/heads/"+name)
+	if err := cmd.Run(); err != nil {
+		if cmd.ExitCode == 1 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func gitBranchAuthorEmail(ctx context.Context, name string) (string, error) {
+	cmd := gitCommand(ctx, "log", "-1", "--format=%ae", "refs/heads/"+name)
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(cmd.Stdout.String()), nil
+}
+
+// gitAvailableBranchName checks if a branch with the given name already
+// exists. Branches of the bot are reused, otherwise a suffix is appended to
+// the name until it no longer collides.
+func gitAvailableBranchName(ctx context.Context, name string) (string, bool, error) {
+	candidate := name
+	for suffix := 2; ; suffix++ {
+		exists, err := gitBranchExists(ctx, candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if !exists {
+			return candidate, false, nil
+		}
+
+		email, err := gitBranchAuthorEmail(ctx, candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if email == botEmail {
+			return candidate, true, nil
+		}
+
+		candidate = fmt.Sprintf("%s-%d", name, suffix)
+	}
+}
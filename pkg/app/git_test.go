@@ -0,0 +1,189 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+func TestRenderBranchNameDeterministic(t *testing.T) {
+	tmpl, err := (&Config{DeterministicBranchName: true}).branchTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := gmpctx.RootPathIntoContext(context.Background(), t.TempDir())
+
+	render := func(results ...Result) string {
+		t.Helper()
+		name, err := renderBranchName(ctx, tmpl, results, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	a := &goModUpdateResult{pkg: "example.com/a", version: "v1.1.0"}
+	b := &goModUpdateResult{pkg: "example.com/b", version: "abcdef123456"}
+	bNewer := &goModUpdateResult{pkg: "example.com/b", version: "123456abcdef"}
+
+	name := render(a, b)
+	if !strings.HasPrefix(name, "vendor_go-mod-promote_") {
+		t.Errorf("unexpected branch name %s", name)
+	}
+	if other := render(b, a); other != name {
+		t.Errorf("branch name depends on the order of the packages: %s != %s", name, other)
+	}
+	if other := render(a, bNewer); other == name {
+		t.Errorf("branch name doesn't change with the versions: %s", name)
+	}
+}
+
+func TestRenderBranchNameInvalidRef(t *testing.T) {
+	tmpl, err := (&Config{BranchTemplate: "update {{ .Hash }}"}).branchTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := gmpctx.RootPathIntoContext(context.Background(), t.TempDir())
+
+	if name, err := renderBranchName(ctx, tmpl, nil, time.Now()); err == nil {
+		t.Fatalf("expected an error for the invalid branch name %q", name)
+	}
+}
+
+func TestGitAvailableBranchName(t *testing.T) {
+	rootPath := gitRepo(t, map[string]string{"go.mod": testGoMod})
+	ctx := gmpctx.RootPathIntoContext(context.Background(), rootPath)
+
+	// update is taken by a human, update-2 by the bot
+	git(t, rootPath, "branch", "update")
+	git(t, rootPath, "checkout", "-q", "-b", "update-2")
+	git(t, rootPath, "commit", "-q", "--allow-empty", "-m", "bot", "--author", botName+" <"+botEmail+">")
+	git(t, rootPath, "checkout", "-q", "-")
+	git(t, rootPath, "branch", "other")
+
+	for _, tc := range []struct {
+		name      string
+		want      string
+		wantReuse bool
+	}{
+		{name: "new", want: "new"},
+		{name: "update", want: "update-2", wantReuse: true},
+		{name: "other", want: "other-2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, reuse, err := gitAvailableBranchName(ctx, tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want || reuse != tc.wantReuse {
+				t.Errorf("expected %s (reuse=%v), got %s (reuse=%v)", tc.want, tc.wantReuse, got, reuse)
+			}
+		})
+	}
+}
+
+func TestGitRevision(t *testing.T) {
+	rootPath := gitRepo(t, map[string]string{"go.mod": testGoMod})
+	ctx := gmpctx.RootPathIntoContext(context.Background(), rootPath)
+
+	want := strings.TrimSpace(git(t, rootPath, "rev-parse", "HEAD"))
+	got, err := gitRevision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestGitHasStagedChanges(t *testing.T) {
+	rootPath := gitRepo(t, map[string]string{"go.mod": testGoMod})
+	ctx := gmpctx.RootPathIntoContext(context.Background(), rootPath)
+
+	expect := func(want bool) {
+		t.Helper()
+		got, err := gitHasStagedChanges(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("expected staged changes %v, got %v", want, got)
+		}
+	}
+
+	expect(false)
+
+	// unstaged changes don't count
+	writeFile(t, filepath.Join(rootPath, "new.txt"), "new")
+	expect(false)
+
+	git(t, rootPath, "add", "-A")
+	expect(true)
+}
+
+func TestGitPushWithCredentials(t *testing.T) {
+	const token = "ghs_s3cr3t"
+	rootPath := gitRepo(t, map[string]string{"go.mod": testGoMod})
+	remotePath := t.TempDir()
+	git(t, remotePath, "init", "-q", "--bare")
+
+	var logs bytes.Buffer
+	ctx := gmpctx.RootPathIntoContext(context.Background(), rootPath)
+	ctx = gmpctx.LoggerIntoContext(ctx, log.NewLogfmtLogger(&logs))
+
+	cmd := gitPushWithCredentials(ctx, remotePath, "x-access-token", token, "HEAD:refs/heads/update")
+	for _, arg := range cmd.Args {
+		if strings.Contains(arg, token) {
+			t.Errorf("token leaked into the arguments: %v", cmd.Args)
+		}
+	}
+	var env []string
+	for _, e := range cmd.Env {
+		if strings.HasPrefix(e, "GMP_GIT_") {
+			env = append(env, e)
+		}
+	}
+	if want := []string{"GMP_GIT_PASSWORD=" + token, "GMP_GIT_USERNAME=x-access-token"}; strings.Join(env, ",") != strings.Join(want, ",") {
+		t.Errorf("expected the credentials %v in the environment, got %v", want, env)
+	}
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("error pushing: %v\n%s", err, cmd.Stderr.String())
+	}
+	if !strings.Contains(logs.String(), "push") {
+		t.Errorf("expected the push command to be logged:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), token) {
+		t.Errorf("token leaked into the logs:\n%s", logs.String())
+	}
+
+	// the credential helper configured in front of push hands out the
+	// credentials from the environment
+	var helperArgs []string
+	for _, arg := range cmd.Args[1:] {
+		if arg == "push" {
+			break
+		}
+		helperArgs = append(helperArgs, arg)
+	}
+	fill := exec.Command("git", append(helperArgs, "credential", "fill")...)
+	fill.Env = cmd.Env
+	fill.Stdin = strings.NewReader("protocol=https\nhost=github.com\n\n")
+	out, err := fill.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"username=x-access-token", "password=" + token} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected %q from the credential helper, got:\n%s", want, out)
+		}
+	}
+}
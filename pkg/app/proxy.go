@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+const defaultGoProxy = "https://proxy.golang.org"
+
+// goProxyURL returns the first module proxy configured in GOPROXY.
+func goProxyURL() (string, error) {
+	goproxy := os.Getenv("GOPROXY")
+	if goproxy == "" {
+		return defaultGoProxy, nil
+	}
+
+	for _, entry := range strings.FieldsFunc(goproxy, func(r rune) bool { return r == ',' || r == '|' }) {
+		if entry == "direct" || entry == "off" {
+			continue
+		}
+		return strings.TrimSuffix(entry, "/"), nil
+	}
+
+	return "", fmt.Errorf("no module proxy configured in GOPROXY=%s", goproxy)
+}
+
+type proxyInfo struct {
+	Version string
+}
+
+// proxyResolve resolves a query like a branch name to the version it refers to
+// using the module proxy's /@v/<query>.info endpoint.
+func proxyResolve(ctx context.Context, path, query string) (string, error) {
+	proxy, err := goProxyURL()
+	if err != nil {
+		return "", err
+	}
+
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return "", err
+	}
+	escapedQuery, err := module.EscapeVersion(query)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s/@v/%s.info", proxy, escapedPath, escapedQuery), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status from module proxy for %s@%s: %s", path, query, resp.Status)
+	}
+
+	var info proxyInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if info.Version == "" {
+		return "", fmt.Errorf("module proxy returned no version for %s@%s", path, query)
+	}
+
+	return info.Version, nil
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+// fakeProxy serves .info files of the given versions keyed by request path.
+func fakeProxy(t *testing.T, versions map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, ok := versions[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"Version":%q,"Time":"2021-01-01T00:00:00Z"}`, version)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGoProxyURL(t *testing.T) {
+	for _, tc := range []struct {
+		goproxy string
+		want    string
+		wantErr bool
+	}{
+		{goproxy: "", want: defaultGoProxy},
+		{goproxy: "https://proxy.example.com/", want: "https://proxy.example.com"},
+		{goproxy: "direct,https://proxy.example.com", want: "https://proxy.example.com"},
+		{goproxy: "https://a.example.com|https://b.example.com", want: "https://a.example.com"},
+		{goproxy: "off", wantErr: true},
+		{goproxy: "direct", wantErr: true},
+	} {
+		t.Run(tc.goproxy, func(t *testing.T) {
+			setEnv(t, "GOPROXY", tc.goproxy)
+
+			got, err := goProxyURL()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyResolve(t *testing.T) {
+	srv := fakeProxy(t, map[string]string{
+		"/github.com/!example/pkg/@v/main.info": "v0.0.0-20210101000000-abcdefabcdef",
+	})
+	setEnv(t, "GOPROXY", srv.URL)
+
+	version, err := proxyResolve(context.Background(), "github.com/Example/pkg", "main")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != "v0.0.0-20210101000000-abcdefabcdef" {
+		t.Errorf("unexpected version %s", version)
+	}
+
+	if _, err := proxyResolve(context.Background(), "github.com/Example/pkg", "unknown"); err == nil {
+		t.Error("expected an error for an unknown branch")
+	}
+}
+
+func TestRunPackageRejectsOlderProxyVersion(t *testing.T) {
+	srv := fakeProxy(t, map[string]string{
+		"/example.com/pkg/@v/main.info": "v1.0.0",
+	})
+	setEnv(t, "GOPROXY", srv.URL)
+
+	a := newApp([]Option{WithModDownloader(fakeDownloader(map[string]*api.GoModDownloadResult{
+		"example.com/pkg":        fakeModule(t, "example.com/pkg", "v1.1.0", "1.15"),
+		"example.com/pkg@v1.0.0": fakeModule(t, "example.com/pkg", "v1.0.0", "1.15"),
+	}))})
+	a.cfg = &Config{}
+	a.downloads = newDownloadCache(a.downloader)
+
+	ctx := gmpctx.ModulePathIntoContext(context.Background(), t.TempDir())
+	_, err := a.runPackage(ctx, nil, "example.com/pkg", Package{Branch: "main", ResolveViaProxy: true}, &PackageReport{})
+	if err == nil || !strings.Contains(err.Error(), "older than the current version") {
+		t.Fatalf("expected an error about an older version, got %v", err)
+	}
+}
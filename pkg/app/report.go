@@ -0,0 +1,128 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/grafana/go-mod-promote/pkg/tasks"
+)
+
+// RunReport summarizes what a run did, so it can be consumed by other
+// automation.
+type RunReport struct {
+	DryRun     bool            `json:"dry_run"`
+	CommitOnly bool            `json:"commit_only,omitempty"` // true if the branch has not been pushed
+	NoOp       bool            `json:"no_op"`                 // true if there was nothing to change
+	Packages   []PackageReport `json:"packages"`
+	// IndirectChanges lists requires, which became direct or indirect
+	IndirectChanges []IndirectChange `json:"indirect_changes,omitempty"`
+	Branch          string           `json:"branch,omitempty"`
+	PullRequestURL  string           `json:"pull_request_url,omitempty"`
+	Error           string           `json:"error,omitempty"`
+}
+
+// PackageReport summarizes the promotion of a single package.
+type PackageReport struct {
+	Name            string     `json:"name"`
+	Module          string     `json:"module,omitempty"`
+	Updated         bool       `json:"updated"`
+	VersionBefore   string     `json:"version_before,omitempty"`
+	VersionAfter    string     `json:"version_after,omitempty"`
+	Ref             string     `json:"ref,omitempty"`
+	Revision        string     `json:"revision,omitempty"`
+	Tasks           []string   `json:"tasks,omitempty"`
+	FilesRenamed    []string   `json:"files_renamed,omitempty"`
+	FilesCopied     []string   `json:"files_copied,omitempty"`
+	FilesDeleted    []string   `json:"files_deleted,omitempty"`
+	FileDiffs       []FileDiff `json:"file_diffs,omitempty"`
+	PatchesApplied  int        `json:"patches_applied"`
+	PatchesRejected int        `json:"patches_rejected"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// IndirectChange is a require of a module, whose indirect marker changed.
+type IndirectChange struct {
+	Module   string `json:"module,omitempty"`
+	Path     string `json:"path"`
+	Version  string `json:"version"`
+	Indirect bool   `json:"indirect"` // the status after the run
+}
+
+// FileDiff is a preview of the changes to a copied file.
+type FileDiff struct {
+	Path string `json:"path"`
+	Diff string `json:"diff"`
+}
+
+// UpdatedPackages returns the names of the packages which have been updated.
+func (r *RunReport) UpdatedPackages() []string {
+	var pkgs []string
+	for _, p := range r.Packages {
+		if p.Updated {
+			pkgs = append(pkgs, p.Name)
+		}
+	}
+	return pkgs
+}
+
+// commitBody lists the version change of each updated package, it is used as
+// body of the commit message.
+func (r *RunReport) commitBody() string {
+	var b strings.Builder
+	for _, p := range r.Packages {
+		if !p.Updated {
+			continue
+		}
+		fmt.Fprintf(&b, "- %s: %s -> %s\n", p.Name, p.VersionBefore, p.VersionAfter)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// addResult records the files a package's task result touches.
+func (r *PackageReport) addResult(result *tasks.Result) {
+	for _, rename := range result.FilesToRename {
+		r.FilesRenamed = append(r.FilesRenamed, rename.From+" => "+rename.To)
+	}
+	for _, c := range result.FilesToCopy {
+		r.FilesCopied = append(r.FilesCopied, c.Destination)
+		if c.Diff != "" {
+			r.FileDiffs = append(r.FileDiffs, FileDiff{Path: c.Destination, Diff: c.Diff})
+		}
+	}
+	for _, d := range result.FilesToDelete {
+		r.FilesDeleted = append(r.FilesDeleted, string(d))
+	}
+}
+
+// addApplied records the outcome of applying a package's task result and
+// returns the number of applied and rejected patches.
+func (r *PackageReport) addApplied(result *tasks.Result, err error) (applied, rejected int) {
+	errs := []error{err}
+	if merr, ok := err.(*multierror.Error); ok {
+		errs = merr.Errors
+	}
+
+	var patchErr *tasks.PatchError
+	for _, e := range errs {
+		if e != nil && errors.As(e, &patchErr) {
+			rejected++
+		}
+	}
+	applied = len(result.Patches) - rejected
+	r.PatchesRejected += rejected
+	r.PatchesApplied += applied
+	return applied, rejected
+}
+
+func (r *RunReport) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -5,7 +5,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -16,28 +22,96 @@ import (
 type Cmd struct {
 	*exec.Cmd
 
-	logger   log.Logger
-	ExitCode int
-	Stdout   bytes.Buffer
-	Stderr   bytes.Buffer
+	ctx        context.Context
+	logger     log.Logger
+	redactions []string
+	ExitCode   int
+	Stdout     bytes.Buffer
+	Stderr     bytes.Buffer
 }
 
 func New(ctx context.Context, command string, args ...string) *Cmd {
 	c := &Cmd{
 		Cmd: exec.CommandContext(ctx, command, args...),
 
-		logger: log.With(gmpctx.LoggerFromContext(ctx), "command", fmt.Sprintf("%v", append([]string{command}, args...))),
+		ctx:    ctx,
+		logger: gmpctx.LoggerFromContext(ctx),
 	}
 
 	c.Cmd.Stdout = &c.Stdout
 	c.Cmd.Stderr = &c.Stderr
 
+	if env := gmpctx.EnvFromContext(ctx); len(env) > 0 {
+		c.Cmd.Env = append(os.Environ(), env...)
+	}
+
 	return c
 
 }
 
+// WithRedaction replaces the given secrets with *** when logging the command
+// arguments, the command itself is executed with the real arguments.
+func (c *Cmd) WithRedaction(secrets ...string) *Cmd {
+	for _, secret := range secrets {
+		if secret != "" {
+			c.redactions = append(c.redactions, secret)
+		}
+	}
+	return c
+}
+
+// WithDir sets the working directory of the command, if dir is empty the
+// command runs in the working directory of the process.
+func (c *Cmd) WithDir(dir string) *Cmd {
+	c.Cmd.Dir = dir
+	return c
+}
+
+// WithEnv sets additional environment variables for the command. They are
+// merged onto the environment of the process and the context, values set
+// here take precedence for duplicate keys. Later calls take precedence over
+// earlier ones.
+func (c *Cmd) WithEnv(env map[string]string) *Cmd {
+	if c.Cmd.Env == nil {
+		c.Cmd.Env = os.Environ()
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		c.Cmd.Env = append(c.Cmd.Env, k+"="+env[k])
+	}
+	return c
+}
+
+func (c *Cmd) commandLogger() log.Logger {
+	return log.With(c.logger, "command", fmt.Sprintf("%v", c.redactArgs(c.Args)))
+}
+
+// redactArgs replaces credentials embedded in URLs and the configured secrets,
+// so they don't end up in the logs.
+func (c *Cmd) redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for pos, arg := range args {
+		if u, err := url.Parse(arg); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "***")
+				arg = u.String()
+			}
+		}
+		for _, secret := range c.redactions {
+			arg = strings.ReplaceAll(arg, secret, "***")
+		}
+		redacted[pos] = arg
+	}
+	return redacted
+}
+
 func (c *Cmd) Start() error {
-	level.Debug(c.logger).Log("msg", "Started execution")
+	level.Debug(c.commandLogger()).Log("msg", "Started execution")
 	if err := c.Cmd.Start(); err != nil {
 		return err
 	}
@@ -47,7 +121,7 @@ func (c *Cmd) Start() error {
 
 func (c *Cmd) Wait() error {
 	err := c.Cmd.Wait()
-	logger := c.logger
+	logger := c.commandLogger()
 	if err != nil {
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
@@ -67,3 +141,104 @@ func (c *Cmd) Run() error {
 	}
 	return c.Wait()
 }
+
+// reset prepares the command to be run again, keeping its arguments,
+// environment and working directory.
+func (c *Cmd) reset() {
+	previous := c.Cmd
+	c.Cmd = exec.CommandContext(c.ctx, previous.Path)
+	c.Cmd.Args = previous.Args
+	c.Cmd.Env = previous.Env
+	c.Cmd.Dir = previous.Dir
+
+	c.ExitCode = 0
+	c.Stdout.Reset()
+	c.Stderr.Reset()
+	c.Cmd.Stdout = &c.Stdout
+	c.Cmd.Stderr = &c.Stderr
+}
+
+// permanentFailures are stderr fragments of failures, which won't go away by
+// retrying, even if they look like network errors.
+var permanentFailures = []string{
+	"the requested url returned error: 4",
+	"authentication failed",
+	"permission denied",
+	"non-fast-forward",
+	"[rejected]",
+	"unknown revision",
+	"invalid version",
+}
+
+// transientFailures are stderr fragments of network failures, which might
+// succeed when retried.
+var transientFailures = []string{
+	"fatal: unable to access",
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"connection reset",
+	"connection refused",
+	"connection timed out",
+	"i/o timeout",
+	"tls handshake timeout",
+	"remote end hung up unexpectedly",
+	"unexpected eof",
+	"early eof",
+	"dial tcp",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"the requested url returned error: 5",
+}
+
+// eofRE matches a plain EOF reported by the command
+var eofRE = regexp.MustCompile(`\bEOF\b`)
+
+// isTransient returns true, if the command failed in a way that might succeed
+// when retried, e.g. because of network issues.
+func isTransient(err error, stderr string) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+
+	lower := strings.ToLower(stderr)
+	for _, fragment := range permanentFailures {
+		if strings.Contains(lower, fragment) {
+			return false
+		}
+	}
+	for _, fragment := range transientFailures {
+		if strings.Contains(lower, fragment) {
+			return true
+		}
+	}
+	return eofRE.MatchString(stderr)
+}
+
+// RunWithRetry runs the command and retries it up to attempts times with an
+// exponential backoff, when it fails with a transient error like a network
+// failure. Other failures are returned immediately. This must only be used
+// for commands which don't read from Stdin.
+func (c *Cmd) RunWithRetry(attempts int, backoff time.Duration) error {
+	for attempt := 1; ; attempt++ {
+		err := c.Run()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		if !isTransient(err, c.Stderr.String()) {
+			return err
+		}
+
+		level.Warn(c.commandLogger()).Log("msg", "retrying failed command", "attempt", attempt, "backoff", backoff, "err", err, "stderr", c.Stderr.String())
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		c.reset()
+	}
+}
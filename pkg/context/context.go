@@ -6,6 +6,7 @@ import (
 	"github.com/go-kit/kit/log"
 
 	"github.com/grafana/go-mod-promote/pkg/api"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
 )
 
 type contextKey int
@@ -16,6 +17,12 @@ const (
 	contextKeyRootPath
 	contextKeyLogger
 	contextKeyGoModFile
+	contextKeyFSRetry
+	contextKeyAllowCommands
+	contextKeyEnv
+	contextKeyModulePath
+	contextKeyTempDir
+	contextKeyNetworkRetry
 )
 
 func GoModBeforeIntoContext(ctx context.Context, b *api.GoModDownloadResult) context.Context {
@@ -26,6 +33,14 @@ func GoModBeforeFromContext(ctx context.Context) *api.GoModDownloadResult {
 	return ctx.Value(contextKeyGoModBefore).(*api.GoModDownloadResult)
 }
 
+func GoModBeforeFromContextOrError(ctx context.Context) (*api.GoModDownloadResult, error) {
+	v, ok := ctx.Value(contextKeyGoModBefore).(*api.GoModDownloadResult)
+	if !ok || v == nil {
+		return nil, gmperr.ErrMissingFromContext{Name: "go.mod before update"}
+	}
+	return v, nil
+}
+
 func GoModAfterIntoContext(ctx context.Context, b *api.GoModDownloadResult) context.Context {
 	return context.WithValue(ctx, contextKeyGoModAfter, b)
 }
@@ -34,6 +49,14 @@ func GoModAfterFromContext(ctx context.Context) *api.GoModDownloadResult {
 	return ctx.Value(contextKeyGoModAfter).(*api.GoModDownloadResult)
 }
 
+func GoModAfterFromContextOrError(ctx context.Context) (*api.GoModDownloadResult, error) {
+	v, ok := ctx.Value(contextKeyGoModAfter).(*api.GoModDownloadResult)
+	if !ok || v == nil {
+		return nil, gmperr.ErrMissingFromContext{Name: "go.mod after update"}
+	}
+	return v, nil
+}
+
 func RootPathIntoContext(ctx context.Context, v string) context.Context {
 	return context.WithValue(ctx, contextKeyRootPath, v)
 }
@@ -42,6 +65,29 @@ func RootPathFromContext(ctx context.Context) string {
 	return ctx.Value(contextKeyRootPath).(string)
 }
 
+func RootPathFromContextOrError(ctx context.Context) (string, error) {
+	v, ok := ctx.Value(contextKeyRootPath).(string)
+	if !ok {
+		return "", gmperr.ErrMissingFromContext{Name: "root path"}
+	}
+	return v, nil
+}
+
+// ModulePathIntoContext sets the directory containing go.mod, if it differs
+// from the root path.
+func ModulePathIntoContext(ctx context.Context, v string) context.Context {
+	return context.WithValue(ctx, contextKeyModulePath, v)
+}
+
+// ModulePathFromContextOrError returns the directory containing go.mod, it
+// defaults to the root path.
+func ModulePathFromContextOrError(ctx context.Context) (string, error) {
+	if v, ok := ctx.Value(contextKeyModulePath).(string); ok && v != "" {
+		return v, nil
+	}
+	return RootPathFromContextOrError(ctx)
+}
+
 func LoggerIntoContext(ctx context.Context, v log.Logger) context.Context {
 	return context.WithValue(ctx, contextKeyLogger, v)
 }
@@ -55,8 +101,75 @@ func LoggerFromContext(ctx context.Context) log.Logger {
 	return l
 }
 
+func FSRetryIntoContext(ctx context.Context, v api.FSRetry) context.Context {
+	return context.WithValue(ctx, contextKeyFSRetry, v)
+}
+
+func FSRetryFromContext(ctx context.Context) api.FSRetry {
+	v, ok := ctx.Value(contextKeyFSRetry).(api.FSRetry)
+	if !ok {
+		return api.DefaultFSRetry
+	}
+
+	return v
+}
+
+func NetworkRetryIntoContext(ctx context.Context, v api.NetworkRetry) context.Context {
+	return context.WithValue(ctx, contextKeyNetworkRetry, v)
+}
+
+// NetworkRetryFromContext returns how operations depending on the network are
+// retried, without a policy in the context they are attempted once.
+func NetworkRetryFromContext(ctx context.Context) api.NetworkRetry {
+	v, ok := ctx.Value(contextKeyNetworkRetry).(api.NetworkRetry)
+	if !ok || v.Attempts <= 0 {
+		return api.NetworkRetry{Attempts: 1}
+	}
+
+	return v
+}
+
+func AllowCommandsIntoContext(ctx context.Context, v bool) context.Context {
+	return context.WithValue(ctx, contextKeyAllowCommands, v)
+}
+
+// AllowCommandsFromContext returns true, if the config allows command tasks
+// to run.
+func AllowCommandsFromContext(ctx context.Context) bool {
+	v, _ := ctx.Value(contextKeyAllowCommands).(bool)
+	return v
+}
+
+// TempDirIntoContext sets the directory, in which tasks create temporary
+// files. It is removed at the end of the run.
+func TempDirIntoContext(ctx context.Context, v string) context.Context {
+	return context.WithValue(ctx, contextKeyTempDir, v)
+}
+
+// TempDirFromContext returns the directory for temporary files, if it is
+// empty the default directory for temporary files is used.
+func TempDirFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(contextKeyTempDir).(string)
+	return v
+}
+
+// EnvIntoContext sets additional environment variables in the form KEY=VALUE
+// for commands run with this context.
+func EnvIntoContext(ctx context.Context, v []string) context.Context {
+	return context.WithValue(ctx, contextKeyEnv, v)
+}
+
+func EnvFromContext(ctx context.Context) []string {
+	v, _ := ctx.Value(contextKeyEnv).([]string)
+	return v
+}
+
 type GoModFile interface {
 	AddReplace(api.GoModReplace) error
+	UpdatePackage(pkg, version string) error
+	AddExclude(path, version string) error
+	DropReplace(oldPath, oldVersion string) error
+	DropRequire(path string) error
 }
 
 func GoModFileIntoContext(ctx context.Context, b GoModFile) context.Context {
@@ -66,3 +179,11 @@ func GoModFileIntoContext(ctx context.Context, b GoModFile) context.Context {
 func GoModFileFromContext(ctx context.Context) GoModFile {
 	return ctx.Value(contextKeyGoModFile).(GoModFile)
 }
+
+func GoModFileFromContextOrError(ctx context.Context) (GoModFile, error) {
+	v, ok := ctx.Value(contextKeyGoModFile).(GoModFile)
+	if !ok {
+		return nil, gmperr.ErrMissingFromContext{Name: "go.mod file"}
+	}
+	return v, nil
+}
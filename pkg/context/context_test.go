@@ -0,0 +1,71 @@
+package context
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+)
+
+func expectMissing(t *testing.T, err error, name string) {
+	t.Helper()
+	var missingErr gmperr.ErrMissingFromContext
+	if !errors.As(err, &missingErr) {
+		t.Fatalf("expected ErrMissingFromContext, got %v", err)
+	}
+	if missingErr.Name != name {
+		t.Errorf("expected %s to be missing, got %s", name, missingErr.Name)
+	}
+}
+
+func TestFromContextOrErrorMissing(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := GoModBeforeFromContextOrError(ctx)
+	expectMissing(t, err, "go.mod before update")
+
+	_, err = GoModAfterFromContextOrError(ctx)
+	expectMissing(t, err, "go.mod after update")
+
+	_, err = RootPathFromContextOrError(ctx)
+	expectMissing(t, err, "root path")
+
+	_, err = ModulePathFromContextOrError(ctx)
+	expectMissing(t, err, "root path")
+
+	_, err = GoModFileFromContextOrError(ctx)
+	expectMissing(t, err, "go.mod file")
+
+	// a nil result is as good as a missing one
+	_, err = GoModAfterFromContextOrError(GoModAfterIntoContext(ctx, nil))
+	expectMissing(t, err, "go.mod after update")
+}
+
+func TestFromContextOrError(t *testing.T) {
+	before := &api.GoModDownloadResult{Version: "v1.0.0"}
+	after := &api.GoModDownloadResult{Version: "v1.1.0"}
+
+	ctx := GoModBeforeIntoContext(context.Background(), before)
+	ctx = GoModAfterIntoContext(ctx, after)
+	ctx = RootPathIntoContext(ctx, "/root")
+
+	if v, err := GoModBeforeFromContextOrError(ctx); err != nil || v != before {
+		t.Errorf("unexpected go.mod before update %v (err=%v)", v, err)
+	}
+	if v, err := GoModAfterFromContextOrError(ctx); err != nil || v != after {
+		t.Errorf("unexpected go.mod after update %v (err=%v)", v, err)
+	}
+	if v, err := RootPathFromContextOrError(ctx); err != nil || v != "/root" {
+		t.Errorf("unexpected root path %s (err=%v)", v, err)
+	}
+
+	// the module path defaults to the root path
+	if v, err := ModulePathFromContextOrError(ctx); err != nil || v != "/root" {
+		t.Errorf("unexpected module path %s (err=%v)", v, err)
+	}
+	if v, err := ModulePathFromContextOrError(ModulePathIntoContext(ctx, "/root/sub")); err != nil || v != "/root/sub" {
+		t.Errorf("unexpected module path %s (err=%v)", v, err)
+	}
+}
@@ -1,8 +1,250 @@
 package errors
 
+import (
+	"fmt"
+	"strings"
+)
+
 type ErrNotImplemented struct {
 }
 
 func (ErrNotImplemented) Error() string {
 	return "Not implemented"
 }
+
+type ErrMissingFromContext struct {
+	Name string
+}
+
+func (e ErrMissingFromContext) Error() string {
+	return fmt.Sprintf("%s not found in context", e.Name)
+}
+
+type ErrCommandsNotAllowed struct {
+	Command string
+}
+
+func (e ErrCommandsNotAllowed) Error() string {
+	return fmt.Sprintf("command '%s' not allowed, set allow_commands to true in the config", e.Command)
+}
+
+// ErrConfigInvalid is returned if the config can't be read or is invalid.
+type ErrConfigInvalid struct {
+	Path string
+	Err  error
+}
+
+func (e ErrConfigInvalid) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid config: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid config '%s': %v", e.Path, e.Err)
+}
+
+func (e ErrConfigInvalid) Unwrap() error {
+	return e.Err
+}
+
+// ErrGoModDownload is returned if go mod download fails for a module.
+type ErrGoModDownload struct {
+	Path   string
+	Output string
+	Err    error
+}
+
+func (e ErrGoModDownload) Error() string {
+	return fmt.Sprintf("error getting go mod download metadata of %s (%s): %v", e.Path, e.Output, e.Err)
+}
+
+func (e ErrGoModDownload) Unwrap() error {
+	return e.Err
+}
+
+// ErrPatchRejected is returned if hunks of a patch could not be applied.
+type ErrPatchRejected struct {
+	Upstream error
+	Reject   []byte // the rejected hunks
+	Output   string // the output of patch
+	Patch    int    // the index of the patch within its result
+}
+
+func (e *ErrPatchRejected) Error() string {
+	return e.Output
+}
+
+func (e *ErrPatchRejected) Unwrap() error {
+	return e.Upstream
+}
+
+// ErrPatchTargetMissing is returned if a file modified by a patch doesn't
+// exist.
+type ErrPatchTargetMissing struct {
+	Path string
+}
+
+func (e ErrPatchTargetMissing) Error() string {
+	return fmt.Sprintf("patch targets missing file %s", e.Path)
+}
+
+// ErrChecksumMismatch is returned if the content of a file doesn't match its
+// expected sha256 digest.
+type ErrChecksumMismatch struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch of '%s': expected sha256 %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// ErrDirtyWorkingDir is returned if the working directory has uncommitted
+// changes and dirty runs are not allowed.
+type ErrDirtyWorkingDir struct {
+}
+
+func (ErrDirtyWorkingDir) Error() string {
+	return "working directory has uncommitted changes, commit or stash them, or use --allow-dirty to stash them during the run"
+}
+
+// ErrGit is returned if a git operation of the run, like checking out the
+// branch, committing or pushing, fails.
+type ErrGit struct {
+	Op     string // e.g. checkout, commit or push
+	Output string
+	Err    error
+}
+
+func (e ErrGit) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("git %s failed: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("git %s failed (%s): %v", e.Op, e.Output, e.Err)
+}
+
+func (e ErrGit) Unwrap() error {
+	return e.Err
+}
+
+// ErrTask is returned if a task of a package fails to run.
+type ErrTask struct {
+	Task string
+	Err  error
+}
+
+func (e ErrTask) Error() string {
+	return fmt.Sprintf("task %s failed: %v", e.Task, e.Err)
+}
+
+func (e ErrTask) Unwrap() error {
+	return e.Err
+}
+
+// ErrGitStash is returned if the dirty working directory can't be stashed.
+type ErrGitStash struct {
+	Output string
+	Err    error
+}
+
+func (e ErrGitStash) Error() string {
+	return fmt.Sprintf("failed to stash dirty working directory (%s): %v", e.Output, e.Err)
+}
+
+func (e ErrGitStash) Unwrap() error {
+	return e.Err
+}
+
+// ErrGitStashPop is returned if the stashed dirty working directory can't be
+// restored after the run. The stash is kept in that case.
+type ErrGitStashPop struct {
+	Output string
+	Err    error
+}
+
+func (e ErrGitStashPop) Error() string {
+	return fmt.Sprintf("failed to restore dirty working directory, it is preserved in the stash and can be restored with 'git stash pop' (%s): %v", e.Output, e.Err)
+}
+
+func (e ErrGitStashPop) Unwrap() error {
+	return e.Err
+}
+
+// ErrPullRequest is returned if the pull request can't be created.
+type ErrPullRequest struct {
+	Owner string
+	Repo  string
+	Head  string
+	Err   error
+}
+
+func (e ErrPullRequest) Error() string {
+	return fmt.Sprintf("failed to create pull request for %s in %s/%s: %v", e.Head, e.Owner, e.Repo, e.Err)
+}
+
+func (e ErrPullRequest) Unwrap() error {
+	return e.Err
+}
+
+// GoModVerifyFailure describes a module that failed go mod verify.
+type GoModVerifyFailure struct {
+	Path    string
+	Version string
+	Reason  string
+	// DownloadMayHelp is true, if running go mod download is likely to
+	// resolve the failure, e.g. a missing go.sum entry or a modified module
+	// cache.
+	DownloadMayHelp bool
+}
+
+func (f GoModVerifyFailure) String() string {
+	var s string
+	switch {
+	case f.Path == "":
+		s = f.Reason
+	case f.Version == "":
+		s = fmt.Sprintf("%s: %s", f.Path, f.Reason)
+	default:
+		s = fmt.Sprintf("%s@%s: %s", f.Path, f.Version, f.Reason)
+	}
+	if f.DownloadMayHelp {
+		s += " (running go mod download may resolve this)"
+	}
+	return s
+}
+
+// ErrGoModVerify is returned if the verification of the updated module fails.
+type ErrGoModVerify struct {
+	Command  []string
+	Failures []GoModVerifyFailure // empty if the output couldn't be parsed
+	Output   string
+	Err      error
+}
+
+func (e ErrGoModVerify) Error() string {
+	if len(e.Failures) == 0 {
+		return fmt.Sprintf("error verifying module with %v (%s): %v", e.Command, e.Output, e.Err)
+	}
+	failures := make([]string, len(e.Failures))
+	for pos := range e.Failures {
+		failures[pos] = e.Failures[pos].String()
+	}
+	return fmt.Sprintf("error verifying module with %v: %s: %v", e.Command, strings.Join(failures, "; "), e.Err)
+}
+
+func (e ErrGoModVerify) Unwrap() error {
+	return e.Err
+}
+
+// DownloadMayHelp returns true, if all failures are likely resolved by
+// running go mod download.
+func (e ErrGoModVerify) DownloadMayHelp() bool {
+	if len(e.Failures) == 0 {
+		return false
+	}
+	for _, f := range e.Failures {
+		if !f.DownloadMayHelp {
+			return false
+		}
+	}
+	return true
+}
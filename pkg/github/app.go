@@ -0,0 +1,138 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/v33/github"
+	"golang.org/x/oauth2"
+
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+// appInstallationUsername is the username to use together with installation
+// tokens for git operations.
+const appInstallationUsername = "x-access-token"
+
+// NewWithAppAuth authenticates as the installation of a GitHub App. The
+// installation tokens are minted using the App's private key and renewed when
+// they expire.
+func NewWithAppAuth(ctx context.Context, appID, installationID int64, privateKeyPEM []byte) (*GitHub, error) {
+	key, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	appClient := github.NewClient(&http.Client{
+		Transport: &appTransport{
+			appID: appID,
+			key:   key,
+		},
+	})
+
+	ts := oauth2.ReuseTokenSource(nil, &installationTokenSource{
+		ctx:            ctx,
+		client:         appClient,
+		installationID: installationID,
+	})
+
+	return &GitHub{
+		logger:      gmpctx.LoggerFromContext(ctx),
+		client:      github.NewClient(oauth2.NewClient(ctx, ts)),
+		tokenSource: ts,
+		app:         true,
+	}, nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in GitHub App private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing GitHub App private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("GitHub App private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
+
+// appTransport authenticates requests as GitHub App using a JWT
+type appTransport struct {
+	appID int64
+	key   *rsa.PrivateKey
+}
+
+func (t *appTransport) jwt() (string, error) {
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(), // allow for clock drift
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": t.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.jwt()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// installationTokenSource mints installation tokens of a GitHub App
+type installationTokenSource struct {
+	ctx            context.Context
+	client         *github.Client
+	installationID int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	token, _, err := s.client.Apps.CreateInstallationToken(s.ctx, s.installationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GitHub App installation token: %w", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		Expiry:      token.GetExpiresAt(),
+	}, nil
+}
@@ -0,0 +1,181 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v33/github"
+)
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// verifyJWT checks the signature of the JWT with the public key and returns
+// its claims.
+func verifyJWT(t *testing.T, token string, key *rsa.PublicKey) map[string]int64 {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a JWT of three parts, got %q", token)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("invalid JWT signature: %v", err)
+	}
+
+	var header map[string]string
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		t.Errorf("unexpected JWT header %v", header)
+	}
+
+	var claims map[string]int64
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestAppTransportJWT(t *testing.T) {
+	key := generateKey(t)
+	transport := &appTransport{appID: 1234, key: key}
+
+	now := time.Now()
+	token, err := transport.jwt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := verifyJWT(t, token, &key.PublicKey)
+
+	if claims["iss"] != 1234 {
+		t.Errorf("expected iss 1234, got %d", claims["iss"])
+	}
+	// iat is backdated for clock drift and exp within GitHub's limit of 10 minutes
+	iat, exp := time.Unix(claims["iat"], 0), time.Unix(claims["exp"], 0)
+	if iat.After(now) || now.Sub(iat) > 2*time.Minute {
+		t.Errorf("unexpected iat %s for now %s", iat, now)
+	}
+	if exp.Before(now) || exp.Sub(iat) > 10*time.Minute {
+		t.Errorf("unexpected exp %s for iat %s", exp, iat)
+	}
+}
+
+func TestInstallationTokenSource(t *testing.T) {
+	key := generateKey(t)
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/42/access_tokens" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			t.Errorf("expected a bearer token, got %q", auth)
+		} else if claims := verifyJWT(t, strings.TrimPrefix(auth, "Bearer "), &key.PublicKey); claims["iss"] != 1234 {
+			t.Errorf("expected iss 1234, got %d", claims["iss"])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"token":      "ghs_installation",
+			"expires_at": expiresAt.Format(time.RFC3339),
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	client := github.NewClient(&http.Client{Transport: &appTransport{appID: 1234, key: key}})
+	baseURL, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = baseURL
+
+	ts := &installationTokenSource{ctx: context.Background(), client: client, installationID: 42}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "ghs_installation" {
+		t.Errorf("unexpected access token %q", token.AccessToken)
+	}
+	if !token.Expiry.Equal(expiresAt) {
+		t.Errorf("expected expiry %s, got %s", expiresAt, token.Expiry)
+	}
+	if requests != 1 {
+		t.Errorf("expected a single request, got %d", requests)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key := generateKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "pkcs1", data: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})},
+		{name: "pkcs8", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})},
+		{name: "no pem", data: []byte("not a key"), wantErr: true},
+		{name: "invalid key", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("invalid")}), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parsePrivateKey(tc.data)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Equal(key) {
+				t.Error("parsed key differs from the generated key")
+			}
+		})
+	}
+}
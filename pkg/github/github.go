@@ -2,6 +2,8 @@ package github
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -12,8 +14,10 @@ import (
 )
 
 type GitHub struct {
-	client *github.Client
-	logger log.Logger
+	client      *github.Client
+	logger      log.Logger
+	tokenSource oauth2.TokenSource
+	app         bool
 }
 
 func New(ctx context.Context, token string) *GitHub {
@@ -21,25 +25,80 @@ func New(ctx context.Context, token string) *GitHub {
 	tc := oauth2.NewClient(ctx, ts)
 
 	return &GitHub{
-		logger: gmpctx.LoggerFromContext(ctx),
-		client: github.NewClient(tc),
+		logger:      gmpctx.LoggerFromContext(ctx),
+		client:      github.NewClient(tc),
+		tokenSource: ts,
 	}
 }
 
+// Token returns the currently valid access token
+func (g *GitHub) Token() (string, error) {
+	token, err := g.tokenSource.Token()
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
 type NewPullRequest = github.NewPullRequest
 type PullRequest = github.PullRequest
 
+// Username returns the username to authenticate git operations with. For
+// GitHub Apps an installation token is minted to verify the credentials.
 func (g *GitHub) Username(ctx context.Context) (string, error) {
-	user, _, err := g.client.Users.Get(ctx, "")
+	if g.app {
+		if _, err := g.Token(); err != nil {
+			return "", err
+		}
+		return appInstallationUsername, nil
+	}
+
+	var user *github.User
+	err := g.retry(ctx, func() (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		user, resp, err = g.client.Users.Get(ctx, "")
+		return resp, err
+	})
 	if err != nil {
 		return "", err
 	}
 
-	return *user.Login, nil
+	if login := user.GetLogin(); login != "" {
+		return login, nil
+	}
+	if name := user.GetName(); name != "" {
+		return name, nil
+	}
+
+	return "", fmt.Errorf("authenticated GitHub user has neither login nor name")
 }
 
+// CreatePR opens a pull request. Creating it is not idempotent, so before it
+// is retried, an open pull request of the head branch is looked up, as the
+// failed attempt might have created it anyway.
 func (g *GitHub) CreatePR(ctx context.Context, owner, repo string, newPR *NewPullRequest) (*PullRequest, error) {
-	pr, _, err := g.client.PullRequests.Create(ctx, owner, repo, newPR)
+	var pr *PullRequest
+	attempted := false
+	err := g.retry(ctx, func() (*github.Response, error) {
+		if attempted {
+			existing, resp, err := g.findPR(ctx, owner, repo, newPR.GetHead())
+			if err != nil {
+				return resp, err
+			}
+			if existing != nil {
+				level.Info(g.logger).Log("msg", "found pull request created by failed attempt", "url", existing.GetHTMLURL())
+				pr = existing
+				return resp, nil
+			}
+		}
+		attempted = true
+
+		var resp *github.Response
+		var err error
+		pr, resp, err = g.client.PullRequests.Create(ctx, owner, repo, newPR)
+		return resp, err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -47,3 +106,39 @@ func (g *GitHub) CreatePR(ctx context.Context, owner, repo string, newPR *NewPul
 	level.Info(g.logger).Log("created pull request", "url", pr.GetURL())
 	return pr, err
 }
+
+// findPR returns the open pull request of the head branch, it is nil if there
+// is none.
+func (g *GitHub) findPR(ctx context.Context, owner, repo, head string) (*PullRequest, *github.Response, error) {
+	if !strings.Contains(head, ":") {
+		head = owner + ":" + head
+	}
+	prs, resp, err := g.client.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State: "open",
+		Head:  head,
+	})
+	if err != nil {
+		return nil, resp, err
+	}
+	if len(prs) == 0 {
+		return nil, resp, nil
+	}
+	return prs[0], resp, nil
+}
+
+func (g *GitHub) AddLabels(ctx context.Context, owner, repo string, number int, labels []string) error {
+	return g.retry(ctx, func() (*github.Response, error) {
+		_, resp, err := g.client.Issues.AddLabelsToIssue(ctx, owner, repo, number, labels)
+		return resp, err
+	})
+}
+
+func (g *GitHub) RequestReviewers(ctx context.Context, owner, repo string, number int, reviewers, teamReviewers []string) error {
+	return g.retry(ctx, func() (*github.Response, error) {
+		_, resp, err := g.client.PullRequests.RequestReviewers(ctx, owner, repo, number, github.ReviewersRequest{
+			Reviewers:     reviewers,
+			TeamReviewers: teamReviewers,
+		})
+		return resp, err
+	})
+}
@@ -0,0 +1,256 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-github/v33/github"
+)
+
+// mockResponse is returned by the mockTransport for a single request.
+type mockResponse struct {
+	status int
+	header http.Header
+	body   string
+}
+
+// mockTransport answers requests with the queued responses in order and
+// records the requests and their bodies.
+type mockTransport struct {
+	t         *testing.T
+	responses []mockResponse
+	requests  []*http.Request
+	bodies    []string
+}
+
+func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.requests = append(m.requests, req)
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	m.bodies = append(m.bodies, string(body))
+
+	if len(m.responses) == 0 {
+		m.t.Fatalf("unexpected request %s %s", req.Method, req.URL)
+	}
+	resp := m.responses[0]
+	m.responses = m.responses[1:]
+
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	for k, v := range resp.header {
+		header[k] = v
+	}
+	return &http.Response{
+		StatusCode: resp.status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp.body)),
+		Request:    req,
+	}, nil
+}
+
+func newTestGitHub(t *testing.T, responses ...mockResponse) (*GitHub, *mockTransport) {
+	transport := &mockTransport{t: t, responses: responses}
+	return &GitHub{
+		client: github.NewClient(&http.Client{Transport: transport}),
+		logger: log.NewNopLogger(),
+	}, transport
+}
+
+func TestUsername(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "login and name", body: `{"login":"bot","name":"The Bot"}`, want: "bot"},
+		{name: "no name", body: `{"login":"bot"}`, want: "bot"},
+		{name: "no login", body: `{"name":"The Bot"}`, want: "The Bot"},
+		{name: "neither", body: `{}`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gh, _ := newTestGitHub(t, mockResponse{status: http.StatusOK, body: tc.body})
+
+			got, err := gh.Username(context.Background())
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestUsernameUnauthorized(t *testing.T) {
+	gh, transport := newTestGitHub(t, mockResponse{status: http.StatusUnauthorized, body: `{"message":"Bad credentials"}`})
+
+	if _, err := gh.Username(context.Background()); err == nil {
+		t.Fatal("expected an error for bad credentials")
+	}
+	if len(transport.requests) != 1 {
+		t.Errorf("expected a single request, got %d", len(transport.requests))
+	}
+}
+
+// rateLimited returns a response of an exceeded rate limit, which resets at
+// the given time.
+func rateLimited(reset time.Time) mockResponse {
+	return mockResponse{
+		status: http.StatusForbidden,
+		header: http.Header{
+			"X-Ratelimit-Limit":     []string{"5000"},
+			"X-Ratelimit-Remaining": []string{"0"},
+			"X-Ratelimit-Reset":     []string{strconv.FormatInt(reset.Unix(), 10)},
+		},
+		body: `{"message":"API rate limit exceeded"}`,
+	}
+}
+
+// abuseRateLimited returns a response of an exceeded secondary rate limit.
+func abuseRateLimited(retryAfter string) mockResponse {
+	resp := mockResponse{
+		status: http.StatusForbidden,
+		body:   `{"message":"You have triggered an abuse detection mechanism","documentation_url":"https://docs.github.com/rest#abuse-rate-limits"}`,
+	}
+	if retryAfter != "" {
+		resp.header = http.Header{"Retry-After": []string{retryAfter}}
+	}
+	return resp
+}
+
+func TestRetryRateLimit(t *testing.T) {
+	user := mockResponse{status: http.StatusOK, body: `{"login":"bot"}`}
+	for _, tc := range []struct {
+		name         string
+		responses    []mockResponse
+		wantErr      bool
+		wantRequests int
+	}{
+		{
+			name:         "rate limit reset",
+			responses:    []mockResponse{rateLimited(time.Now().Add(-time.Second)), user},
+			wantRequests: 2,
+		},
+		{
+			name:         "secondary rate limit",
+			responses:    []mockResponse{abuseRateLimited("0"), user},
+			wantRequests: 2,
+		},
+		{
+			name:         "retried only once",
+			responses:    []mockResponse{rateLimited(time.Now().Add(-time.Second)), abuseRateLimited("0")},
+			wantErr:      true,
+			wantRequests: 2,
+		},
+		{
+			name:         "reset too late",
+			responses:    []mockResponse{rateLimited(time.Now().Add(maxRateLimitWait + time.Minute))},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "client error",
+			responses:    []mockResponse{{status: http.StatusNotFound, body: `{"message":"Not Found"}`}},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gh, transport := newTestGitHub(t, tc.responses...)
+
+			got, err := gh.Username(context.Background())
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if got != "bot" {
+				t.Errorf("unexpected username %s", got)
+			}
+			if len(transport.requests) != tc.wantRequests {
+				t.Errorf("expected %d requests, got %d", tc.wantRequests, len(transport.requests))
+			}
+		})
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	backoff := 3 * time.Second
+	for _, tc := range []struct {
+		name     string
+		err      error
+		want     time.Duration
+		wantRate bool
+	}{
+		{name: "other error", err: errors.New("boom")},
+		{name: "abuse with retry after", err: &github.AbuseRateLimitError{RetryAfter: durationPtr(time.Minute)}, want: time.Minute, wantRate: true},
+		{name: "abuse without retry after", err: &github.AbuseRateLimitError{}, want: backoff, wantRate: true},
+		{name: "wrapped", err: fmt.Errorf("creating PR: %w", &github.AbuseRateLimitError{}), want: backoff, wantRate: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := rateLimitWait(tc.err, backoff)
+			if ok != tc.wantRate || got != tc.want {
+				t.Errorf("expected %s (rate limit=%v), got %s (rate limit=%v)", tc.want, tc.wantRate, got, ok)
+			}
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestCreatePRDraft(t *testing.T) {
+	for _, draft := range []bool{false, true} {
+		t.Run(strconv.FormatBool(draft), func(t *testing.T) {
+			gh, transport := newTestGitHub(t, mockResponse{
+				status: http.StatusCreated,
+				body:   fmt.Sprintf(`{"number":1,"draft":%v}`, draft),
+			})
+
+			pr, err := gh.CreatePR(context.Background(), "org", "repo", &NewPullRequest{
+				Title: github.String("update"),
+				Head:  github.String("update"),
+				Base:  github.String("main"),
+				Draft: github.Bool(draft),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sent NewPullRequest
+			if err := json.Unmarshal([]byte(transport.bodies[0]), &sent); err != nil {
+				t.Fatal(err)
+			}
+			if sent.GetDraft() != draft {
+				t.Errorf("expected the request to set draft=%v, got %s", draft, transport.bodies[0])
+			}
+			if pr.GetDraft() != draft {
+				t.Errorf("expected the created PR to be draft=%v", draft)
+			}
+		})
+	}
+}
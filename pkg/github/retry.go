@@ -0,0 +1,80 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/go-github/v33/github"
+)
+
+const (
+	retryAttempts = 3
+	retryBackoff  = 2 * time.Second
+
+	// maxRateLimitWait bounds the time waited for a rate limit to reset
+	maxRateLimitWait = 5 * time.Minute
+)
+
+// rateLimitWait returns how long to wait for a rate limit to reset, it returns
+// false if the error is not caused by a rate limit.
+func rateLimitWait(err error, backoff time.Duration) (time.Duration, bool) {
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		return time.Until(rateErr.Rate.Reset.Time), true
+	}
+
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter, true
+		}
+		return backoff, true
+	}
+
+	return 0, false
+}
+
+// retry calls op and retries it with an exponential backoff, when it fails
+// with a server error. When hitting a rate limit, it waits for the limit to
+// reset and retries once.
+func (g *GitHub) retry(ctx context.Context, op func() (*github.Response, error)) error {
+	backoff := retryBackoff
+	rateLimited := false
+	for attempt := 1; ; attempt++ {
+		resp, err := op()
+		if err == nil {
+			return nil
+		}
+
+		var wait time.Duration
+		if rateWait, ok := rateLimitWait(err, backoff); ok {
+			if rateLimited {
+				return err
+			}
+			if rateWait > maxRateLimitWait {
+				level.Warn(g.logger).Log("msg", "GitHub rate limit resets too late to wait for it", "wait", rateWait)
+				return err
+			}
+			if rateWait < 0 {
+				rateWait = 0
+			}
+			rateLimited = true
+			wait = rateWait
+			level.Info(g.logger).Log("msg", "hit GitHub rate limit, waiting for it to reset", "wait", wait)
+		} else if resp != nil && resp.StatusCode >= 500 && attempt < retryAttempts {
+			wait = backoff
+			backoff *= 2
+			level.Warn(g.logger).Log("msg", "retrying failed GitHub request", "attempt", attempt, "wait", wait, "err", err)
+		} else {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -2,24 +2,34 @@ package gomod
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 
 	"github.com/grafana/go-mod-promote/pkg/api"
 	"github.com/grafana/go-mod-promote/pkg/command"
 	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
 )
 
+// managedCommentPrefix marks go.mod entries managed by go-mod-promote
+const managedCommentPrefix = "// [go-mod-promote]"
+
 type GoMod struct {
 	file     *modfile.File
 	path     string
+	original []byte
 	logger   log.Logger
 	replaces []api.GoModReplace
 }
@@ -32,20 +42,54 @@ func NewGoModFromPath(path string) (*GoMod, error) {
 
 	goMod, err := modfile.Parse("go.mod", goModData, nil)
 	if err != nil {
+		if unsupportedErr := unsupportedDirective(goModData); unsupportedErr != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", path, unsupportedErr)
+		}
 		return nil, err
 	}
 
 	return &GoMod{
-		file:   goMod,
-		path:   path,
-		logger: log.NewNopLogger(),
+		file:     goMod,
+		path:     path,
+		original: goModData,
+		logger:   log.NewNopLogger(),
 	}, nil
 }
 
+// unsupportedDirective explains why the go.mod data can't be parsed, if it
+// uses directives introduced after the supported go.mod format: toolchain
+// directives and go directives other than 1.23 like 1.21.0 or 1.21rc1.
+func unsupportedDirective(data []byte) error {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch {
+		case fields[0] == "toolchain":
+			return fmt.Errorf("toolchain directives are not supported")
+		case fields[0] == "go" && !modfile.GoVersionRE.MatchString(fields[1]):
+			return fmt.Errorf("go version '%s' is not supported, it must match the format 1.23", fields[1])
+		}
+	}
+	return nil
+}
+
+// NewGoModFromContext reads the go.mod file of the module path, which
+// defaults to the root path.
 func NewGoModFromContext(ctx context.Context) (*GoMod, error) {
+	modulePath, err := gmpctx.ModulePathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewGoModFromDir(ctx, modulePath)
+}
+
+// NewGoModFromDir reads the go.mod file in dir.
+func NewGoModFromDir(ctx context.Context, dir string) (*GoMod, error) {
 	logger := gmpctx.LoggerFromContext(ctx)
 	logger = log.With(logger, "module", "gomod")
-	path := filepath.Join(gmpctx.RootPathFromContext(ctx), "go.mod")
+	path := filepath.Join(dir, "go.mod")
 
 	goMod, err := NewGoModFromPath(path)
 	if err != nil {
@@ -64,6 +108,103 @@ func (g *GoMod) GetReplaces() []api.GoModReplace {
 	return replaces
 }
 
+// GetRequires returns all require directives in the order of the go.mod file.
+func (g *GoMod) GetRequires() []api.GoModRequire {
+	requires := make([]api.GoModRequire, len(g.file.Require))
+	for pos, r := range g.file.Require {
+		requires[pos] = api.GoModRequire{
+			Version:  r.Mod,
+			Indirect: r.Indirect,
+		}
+		if r.Syntax == nil {
+			continue
+		}
+		for _, c := range append(r.Syntax.Before, r.Syntax.Suffix...) {
+			if strings.TrimSpace(strings.TrimPrefix(c.Token, "//")) == "indirect" {
+				continue
+			}
+			requires[pos].Comments = append(requires[pos].Comments, c.Token)
+		}
+	}
+	return requires
+}
+
+// IndirectChanges compares the go.mod file on disk with the one originally
+// read and returns the requires, whose indirect marker has changed. It is
+// meant to be called after Finish, so changes of go mod tidy are included.
+func (g *GoMod) IndirectChanges() ([]api.GoModRequire, error) {
+	original, err := modfile.Parse("go.mod", g.original, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(g.path)
+	if err != nil {
+		return nil, err
+	}
+	current, err := modfile.Parse("go.mod", data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	indirect := make(map[string]bool, len(original.Require))
+	for _, r := range original.Require {
+		indirect[r.Mod.Path] = r.Indirect
+	}
+
+	var changes []api.GoModRequire
+	for _, r := range current.Require {
+		if before, ok := indirect[r.Mod.Path]; ok && before != r.Indirect {
+			changes = append(changes, api.GoModRequire{
+				Version:  r.Mod,
+				Indirect: r.Indirect,
+			})
+		}
+	}
+	return changes, nil
+}
+
+func (g *GoMod) GetExcludes() []module.Version {
+	excludes := make([]module.Version, len(g.file.Exclude))
+	for pos := range g.file.Exclude {
+		excludes[pos] = g.file.Exclude[pos].Mod
+	}
+	return excludes
+}
+
+// GoVersion returns the version of the go directive, it is empty if the
+// go.mod file has no go directive.
+func (g *GoMod) GoVersion() string {
+	if g.file.Go == nil {
+		return ""
+	}
+	return g.file.Go.Version
+}
+
+// goReleaseRE matches go release versions, with or without patch version.
+var goReleaseRE = regexp.MustCompile(`^[1-9][0-9]*\.(0|[1-9][0-9]*)(\.(0|[1-9][0-9]*))?$`)
+
+// RaiseGoVersion sets the go directive to version, if it is newer than the
+// current one. It never lowers the version, 1.21 and 1.21.0 are equal.
+// Pre-releases like 1.21rc1 are rejected, as well as raising to a patch
+// release like 1.21.1, as the go directive must match the format 1.23.
+func (g *GoMod) RaiseGoVersion(version string) error {
+	if !goReleaseRE.MatchString(version) {
+		return fmt.Errorf("unsupported go version '%s', only releases like 1.21 or 1.21.0 can be raised to", version)
+	}
+	current := g.GoVersion()
+	if current != "" && semver.Compare("v"+version, "v"+current) <= 0 {
+		return nil
+	}
+
+	majorMinor := strings.TrimPrefix(semver.MajorMinor("v"+version), "v")
+	if semver.Compare("v"+version, "v"+majorMinor) != 0 {
+		return fmt.Errorf("unsupported go version '%s', the go directive can't be raised to patch releases", version)
+	}
+
+	level.Info(g.logger).Log("msg", "raise go directive", "from", current, "to", majorMinor)
+	return g.file.AddGoStmt(majorMinor)
+}
+
 func (g *GoMod) GetVersionForPackage(pkg string) (string, error) {
 
 	for _, require := range g.file.Require {
@@ -84,6 +225,13 @@ func (g *GoMod) AddReplace(r api.GoModReplace) error {
 	return nil
 }
 
+func (g *GoMod) AddExclude(path, version string) error {
+	logger := log.With(g.logger, "pkg", path, "version", version)
+	level.Debug(logger).Log("msg", "add exclude")
+
+	return g.file.AddExclude(path, version)
+}
+
 func (g *GoMod) UpdatePackage(pkg, version string) error {
 	logger := log.With(g.logger, "pkg", pkg, "version", version)
 	level.Debug(logger).Log("msg", "update package")
@@ -126,45 +274,260 @@ func (g *GoMod) addReplace(input api.GoModReplace) error {
 		return err
 	}
 
-	// if comment is empty we are finished
-	if input.Comment == "" {
-		return nil
-	}
-
 	// iterate throug entries
-
 	for _, r := range g.file.Replace {
 		if r.Old.Path == input.Old.Path && (input.Old.Version == "" || r.Old.Version == input.Old.Version) {
+			// if comment is empty, make sure the entry isn't managed
+			// anymore, as it might have been overwritten
+			if input.Comment == "" {
+				if r.Syntax != nil {
+					r.Syntax.Before = unmanagedComments(r.Syntax.Before)
+				}
+				return nil
+			}
 
 			if r.Syntax == nil {
 				r.Syntax = &modfile.Line{}
 			}
 
-			r.Syntax.Before = []modfile.Comment{{
-				Token: "// [go-mod-promote] " + input.Comment,
-			}}
+			r.Syntax.Before = withManagedComment(r.Syntax.Before, managedCommentPrefix+" "+input.Comment)
 
 			return nil
 		}
 	}
 
+	if input.Comment == "" {
+		return nil
+	}
 	return fmt.Errorf("error entry was not found to add comment")
 }
 
-func (g *GoMod) Finish(ctx context.Context, vendorEnabled bool) error {
-	// sort replaces by priority
-	sort.Slice(g.replaces, func(i, j int) bool {
-		return g.replaces[i].Priority < g.replaces[j].Priority
+// unmanagedComments returns the comments, which haven't been added by
+// go-mod-promote.
+func unmanagedComments(comments []modfile.Comment) []modfile.Comment {
+	var result []modfile.Comment
+	for _, c := range comments {
+		if strings.HasPrefix(c.Token, managedCommentPrefix) {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// withManagedComment replaces an existing go-mod-promote comment with token,
+// or appends it after the other comments.
+func withManagedComment(comments []modfile.Comment, token string) []modfile.Comment {
+	var result []modfile.Comment
+	replaced := false
+	for _, c := range comments {
+		if !strings.HasPrefix(c.Token, managedCommentPrefix) {
+			result = append(result, c)
+			continue
+		}
+		if !replaced {
+			result = append(result, modfile.Comment{Token: token})
+			replaced = true
+		}
+	}
+	if !replaced {
+		result = append(result, modfile.Comment{Token: token})
+	}
+	return result
+}
+
+// resolveReplaces returns the replaces with the highest priority per old
+// module path and version, ordered by ascending priority. For equal
+// priorities the replace added last wins.
+func resolveReplaces(replaces []api.GoModReplace) []api.GoModReplace {
+	winners := make(map[module.Version]int, len(replaces))
+	for pos, r := range replaces {
+		if current, ok := winners[r.Old]; ok && replaces[current].Priority > r.Priority {
+			continue
+		}
+		winners[r.Old] = pos
+	}
+
+	result := make([]api.GoModReplace, 0, len(winners))
+	for pos, r := range replaces {
+		if winners[r.Old] == pos {
+			result = append(result, r)
+		}
+	}
+
+	// a replace without old version overwrites all versioned replaces of the
+	// same path, so versioned replaces of a higher priority are applied last
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Priority < result[j].Priority
 	})
 
+	return result
+}
+
+// managedComment returns the go-mod-promote comment of a replace, it is empty
+// if the replace is not managed.
+func managedComment(r *modfile.Replace) string {
+	if r.Syntax == nil {
+		return ""
+	}
+	for _, c := range r.Syntax.Before {
+		if strings.HasPrefix(c.Token, managedCommentPrefix) {
+			return c.Token
+		}
+	}
+	return ""
+}
+
+// managedSource returns the module a managed comment refers to, by convention
+// this is the last word after "from".
+func managedSource(comment string) string {
+	fields := strings.Fields(strings.TrimPrefix(comment, managedCommentPrefix))
+	if len(fields) < 2 || fields[len(fields)-2] != "from" {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+// OrphanedReplaces returns the managed replaces, which originate from a module
+// that is not part of sources.
+func (g *GoMod) OrphanedReplaces(sources []string) []module.Version {
+	known := make(map[string]struct{}, len(sources))
+	for _, source := range sources {
+		known[source] = struct{}{}
+	}
+
+	var orphaned []module.Version
+	for _, r := range g.file.Replace {
+		source := managedSource(managedComment(r))
+		if source == "" {
+			continue
+		}
+		if _, ok := known[source]; ok {
+			continue
+		}
+		orphaned = append(orphaned, r.Old)
+	}
+
+	return orphaned
+}
+
+func (g *GoMod) DropReplace(oldPath, oldVersion string) error {
+	logger := log.With(g.logger, "pkg", oldPath, "version", oldVersion)
+	level.Debug(logger).Log("msg", "drop replace")
+
+	if err := g.file.DropReplace(oldPath, oldVersion); err != nil {
+		return err
+	}
+	g.file.Cleanup()
+
+	// also forget about replaces added in this run, so Finish doesn't add
+	// them back
+	replaces := g.replaces[:0]
+	for _, r := range g.replaces {
+		if r.Old.Path == oldPath && r.Old.Version == oldVersion {
+			continue
+		}
+		replaces = append(replaces, r)
+	}
+	g.replaces = replaces
+
+	return nil
+}
+
+func (g *GoMod) DropRequire(path string) error {
+	logger := log.With(g.logger, "pkg", path)
+	level.Debug(logger).Log("msg", "drop require")
+
+	if err := g.file.DropRequire(path); err != nil {
+		return err
+	}
+	g.file.Cleanup()
+
+	return nil
+}
+
+// PruneManagedReplaces drops managed replaces, which have not been re-added in
+// this run, although a replace with the same comment has been. This removes
+// entries that have disappeared upstream, while keeping the ones of packages
+// which have not been updated.
+func (g *GoMod) PruneManagedReplaces() error {
+	comments := make(map[string]struct{})
+	for _, r := range g.replaces {
+		if r.Comment != "" {
+			comments[managedCommentPrefix+" "+r.Comment] = struct{}{}
+		}
+	}
+
+	readded := func(old module.Version) bool {
+		for _, r := range g.replaces {
+			if r.Old.Path == old.Path && (r.Old.Version == "" || r.Old.Version == old.Version) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var stale []module.Version
+	for _, r := range g.file.Replace {
+		comment := managedComment(r)
+		if comment == "" {
+			continue
+		}
+		if _, ok := comments[comment]; !ok {
+			continue
+		}
+		if readded(r.Old) {
+			continue
+		}
+		stale = append(stale, r.Old)
+	}
+
+	for _, old := range stale {
+		level.Info(g.logger).Log("msg", "drop managed replace removed upstream", "pkg", old.Path, "version", old.Version)
+		if err := g.file.DropReplace(old.Path, old.Version); err != nil {
+			return err
+		}
+	}
+	g.file.Cleanup()
+
+	return nil
+}
+
+type FinishOptions struct {
+	// Run go mod tidy after writing go.mod
+	Tidy bool
+	// Run go mod vendor after writing go.mod
+	Vendor bool
+	// VerifyCommand replaces go mod verify as verification step, if set
+	VerifyCommand []string
+	// If AutoUpdateGoSum is set, go mod download is run and the verification
+	// is retried once, when the failure is likely resolved by it
+	AutoUpdateGoSum bool
+}
+
+// format resolves the collected replaces into the go.mod file and returns its
+// formatted content.
+func (g *GoMod) format() ([]byte, error) {
+	// only keep the highest priority replace per module
+	g.replaces = resolveReplaces(g.replaces)
+
+	// remove managed replaces, that are no longer added
+	if err := g.PruneManagedReplaces(); err != nil {
+		return nil, err
+	}
+
 	// add replaces as necessary
 	for _, replace := range g.replaces {
 		if err := g.addReplace(replace); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	data, err := g.file.Format()
+	return g.file.Format()
+}
+
+func (g *GoMod) Finish(ctx context.Context, opts FinishOptions) error {
+	data, err := g.format()
 	if err != nil {
 		return err
 	}
@@ -174,17 +537,132 @@ func (g *GoMod) Finish(ctx context.Context, vendorEnabled bool) error {
 		return err
 	}
 
-	// Run go mod verify
-	if err := command.New(ctx, "go", "mod", "verify").Run(); err != nil {
-		return err
+	// Tidy go.mod only if configured to do so, this needs to happen after
+	// writing go.mod, so it sees the updated requires
+	if opts.Tidy {
+		cmd := command.New(ctx, "go", "mod", "tidy").WithDir(filepath.Dir(g.path))
+		err := cmd.Run()
+		level.Debug(g.logger).Log("msg", "go mod tidy", "stdout", cmd.Stdout.String(), "stderr", cmd.Stderr.String())
+		if err != nil {
+			return fmt.Errorf("error running go mod tidy (%s): %w", cmd.Stderr.String(), err)
+		}
+	}
+
+	// Run go mod verify or the configured verification command
+	if err := g.verify(ctx, opts.VerifyCommand); err != nil {
+		var verifyErr gmperr.ErrGoModVerify
+		if !opts.AutoUpdateGoSum || !errors.As(err, &verifyErr) || !verifyErr.DownloadMayHelp() {
+			return err
+		}
+
+		level.Warn(g.logger).Log("msg", "verification failed, updating go.sum and retrying", "err", err)
+		cmd := command.New(ctx, "go", "mod", "download").WithDir(filepath.Dir(g.path))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error running go mod download (%s): %w", cmd.Stderr.String(), err)
+		}
+		if err := g.verify(ctx, opts.VerifyCommand); err != nil {
+			return err
+		}
 	}
 
 	// Write vendor folder only do if configured to do so
-	if vendorEnabled {
-		if err := command.New(ctx, "go", "mod", "vendor").Run(); err != nil {
+	if opts.Vendor {
+		if err := command.New(ctx, "go", "mod", "vendor").WithDir(filepath.Dir(g.path)).Run(); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// verify runs go mod verify or the given verification command. Failures of go
+// mod verify are parsed into a ErrGoModVerify.
+func (g *GoMod) verify(ctx context.Context, verifyCommand []string) error {
+	parse := len(verifyCommand) == 0
+	if parse {
+		verifyCommand = []string{"go", "mod", "verify"}
+	}
+
+	cmd := command.New(ctx, verifyCommand[0], verifyCommand[1:]...).WithDir(filepath.Dir(g.path))
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(cmd.Stdout.String() + "\n" + cmd.Stderr.String())
+		verifyErr := gmperr.ErrGoModVerify{
+			Command: verifyCommand,
+			Output:  output,
+			Err:     err,
+		}
+		if parse {
+			verifyErr.Failures = parseVerifyOutput(output)
+		}
+		return verifyErr
+	}
+	return nil
+}
+
+// Path returns the path of the go.mod file.
+func (g *GoMod) Path() string {
+	return g.path
+}
+
+// Diff returns a unified diff between the go.mod file as it was read and its
+// current content on disk. The file is labeled as name in the diff.
+func (g *GoMod) Diff(ctx context.Context, name string) ([]byte, error) {
+	return g.diff(ctx, name, g.path)
+}
+
+// PreviewDiff returns a unified diff between the go.mod file as it was read
+// and the content Finish would write, without writing it. The file is labeled
+// as name in the diff.
+func (g *GoMod) PreviewDiff(ctx context.Context, name string) ([]byte, error) {
+	data, err := g.format()
+	if err != nil {
+		return nil, err
+	}
+
+	previewFile, err := ioutil.TempFile("", "go.mod")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(previewFile.Name())
+
+	if _, err := previewFile.Write(data); err != nil {
+		previewFile.Close()
+		return nil, err
+	}
+	if err := previewFile.Close(); err != nil {
+		return nil, err
+	}
+
+	return g.diff(ctx, name, previewFile.Name())
+}
+
+// diff returns a unified diff between the go.mod file as it was read and the
+// file at path.
+func (g *GoMod) diff(ctx context.Context, name, path string) ([]byte, error) {
+	originalFile, err := ioutil.TempFile("", "go.mod")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(originalFile.Name())
+
+	if _, err := originalFile.Write(g.original); err != nil {
+		originalFile.Close()
+		return nil, err
+	}
+	if err := originalFile.Close(); err != nil {
+		return nil, err
+	}
+
+	cmd := command.New(ctx, "diff",
+		"-u",
+		"--label", "old/"+name,
+		"--label", "new/"+name,
+		originalFile.Name(),
+		path,
+	)
+	if err := cmd.Run(); err != nil && cmd.ExitCode != 1 {
+		return nil, fmt.Errorf("error creating go.mod diff (%s): %w", cmd.Stderr.String(), err)
+	}
+
+	return cmd.Stdout.Bytes(), nil
+}
@@ -0,0 +1,468 @@
+package gomod
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+)
+
+func newTestGoMod(t *testing.T, content string) *GoMod {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "go.mod")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGoModFromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func replace(oldPath, newPath, newVersion string, priority api.GoModReplacePriority, comment string) api.GoModReplace {
+	return api.GoModReplace{
+		Replace: modfile.Replace{
+			Old: module.Version{Path: oldPath},
+			New: module.Version{Path: newPath, Version: newVersion},
+		},
+		Priority: priority,
+		Comment:  comment,
+	}
+}
+
+// replacesOf returns the replaces of the formatted go.mod as "old => new
+// version" lines.
+func replacesOf(t *testing.T, g *GoMod) []string {
+	t.Helper()
+	data, err := g.format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := modfile.Parse("go.mod", data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, r := range f.Replace {
+		result = append(result, r.Old.Path+" => "+r.New.Path+" "+r.New.Version)
+	}
+	return result
+}
+
+const managedGoMod = `module example.com/app
+
+go 1.15
+
+replace (
+	// [go-mod-promote] pinned version from example.com/up
+	example.com/x => example.com/x v1.0.0
+	// [go-mod-promote] pinned version from example.com/up
+	example.com/y => example.com/y v1.0.0
+	// added by hand
+	example.com/z => example.com/z v1.0.0
+)
+`
+
+func TestPruneManagedReplaces(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		replaces []api.GoModReplace
+		want     []string
+	}{
+		{
+			name: "package not updated keeps its replaces",
+			want: []string{
+				"example.com/x => example.com/x v1.0.0",
+				"example.com/y => example.com/y v1.0.0",
+				"example.com/z => example.com/z v1.0.0",
+			},
+		},
+		{
+			name: "replace removed upstream is dropped",
+			replaces: []api.GoModReplace{
+				replace("example.com/x", "example.com/x", "v1.1.0", api.GoModReplaceUpstreamPackageVersion, "pinned version from example.com/up"),
+			},
+			want: []string{
+				"example.com/x => example.com/x v1.1.0",
+				"example.com/z => example.com/z v1.0.0",
+			},
+		},
+		{
+			name: "replaces of other packages are kept",
+			replaces: []api.GoModReplace{
+				replace("example.com/x", "example.com/x", "v1.1.0", api.GoModReplaceUpstreamPackageVersion, "pinned version from example.com/other"),
+			},
+			want: []string{
+				"example.com/x => example.com/x v1.1.0",
+				"example.com/y => example.com/y v1.0.0",
+				"example.com/z => example.com/z v1.0.0",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newTestGoMod(t, managedGoMod)
+			for _, r := range tc.replaces {
+				if err := g.AddReplace(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := replacesOf(t, g)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("unexpected replaces:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestOrphanedReplaces(t *testing.T) {
+	g := newTestGoMod(t, `module example.com/app
+
+go 1.15
+
+replace (
+	// [go-mod-promote] pinned version from example.com/up
+	example.com/x => example.com/x v1.0.0
+	// [go-mod-promote] pinned version from example.com/gone
+	example.com/y v1.0.0 => example.com/y v1.0.1
+	// added by hand
+	example.com/z => example.com/z v1.0.0
+)
+`)
+
+	orphaned := g.OrphanedReplaces([]string{"example.com/up"})
+	if len(orphaned) != 1 || orphaned[0] != (module.Version{Path: "example.com/y", Version: "v1.0.0"}) {
+		t.Fatalf("unexpected orphaned replaces %v", orphaned)
+	}
+
+	for _, r := range orphaned {
+		if err := g.DropReplace(r.Path, r.Version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := replacesOf(t, g)
+	want := []string{
+		"example.com/x => example.com/x v1.0.0",
+		"example.com/z => example.com/z v1.0.0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected replaces:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFinishWithVerifyCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		command    []string
+		wantOutput string
+	}{
+		{name: "success", command: []string{"true"}},
+		{name: "failure", command: []string{"sh", "-c", "echo broken; exit 1"}, wantOutput: "broken"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newTestGoMod(t, "module example.com/app\n\ngo 1.15\n\nrequire example.com/pkg v1.0.0\n")
+			if err := g.UpdatePackage("example.com/pkg", "v1.1.0"); err != nil {
+				t.Fatal(err)
+			}
+
+			err := g.Finish(context.Background(), FinishOptions{VerifyCommand: tc.command})
+			if tc.wantOutput == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				var verifyErr gmperr.ErrGoModVerify
+				if !errors.As(err, &verifyErr) {
+					t.Fatalf("expected ErrGoModVerify, got %v", err)
+				}
+				if verifyErr.Output != tc.wantOutput {
+					t.Errorf("expected output %q, got %q", tc.wantOutput, verifyErr.Output)
+				}
+				if len(verifyErr.Failures) != 0 {
+					t.Errorf("the output of a custom command must not be parsed, got %v", verifyErr.Failures)
+				}
+			}
+
+			// go.mod is written before the verification
+			data, err := ioutil.ReadFile(g.Path())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "example.com/pkg v1.1.0") {
+				t.Errorf("go.mod hasn't been updated:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestManagedReplaceParsing(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		goMod       string
+		wantComment string
+		wantSource  string
+	}{
+		{
+			name:  "unmanaged",
+			goMod: "replace example.com/x => example.com/x v1.0.0\n",
+		},
+		{
+			name:  "human comment",
+			goMod: "// keep until upstream is fixed\nreplace example.com/x => example.com/x v1.0.0\n",
+		},
+		{
+			name:        "managed",
+			goMod:       "// [go-mod-promote] pinned version from example.com/up\nreplace example.com/x => example.com/x v1.0.0\n",
+			wantComment: "// [go-mod-promote] pinned version from example.com/up",
+			wantSource:  "example.com/up",
+		},
+		{
+			name:        "managed after human comment",
+			goMod:       "// keep until upstream is fixed\n// [go-mod-promote] local replace from example.com/up\nreplace example.com/x => ../x\n",
+			wantComment: "// [go-mod-promote] local replace from example.com/up",
+			wantSource:  "example.com/up",
+		},
+		{
+			name:        "managed within block",
+			goMod:       "replace (\n\t// [go-mod-promote] pinned version from example.com/up\n\texample.com/x => example.com/x v1.0.0\n)\n",
+			wantComment: "// [go-mod-promote] pinned version from example.com/up",
+			wantSource:  "example.com/up",
+		},
+		{
+			name:        "managed without source",
+			goMod:       "// [go-mod-promote] pinned\nreplace example.com/x => example.com/x v1.0.0\n",
+			wantComment: "// [go-mod-promote] pinned",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := modfile.Parse("go.mod", []byte("module example.com/app\n\n"+tc.goMod), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(f.Replace) != 1 {
+				t.Fatalf("expected a single replace, got %d", len(f.Replace))
+			}
+
+			comment := managedComment(f.Replace[0])
+			if comment != tc.wantComment {
+				t.Errorf("expected comment %q, got %q", tc.wantComment, comment)
+			}
+			if source := managedSource(comment); source != tc.wantSource {
+				t.Errorf("expected source %q, got %q", tc.wantSource, source)
+			}
+		})
+	}
+}
+
+func TestReplacePriority(t *testing.T) {
+	upstreamReplace := replace("example.com/x", "example.com/x", "v1.0.0", api.GoModReplaceUpstreamReplace, "")
+	upstreamVersion := replace("example.com/x", "example.com/x", "v1.1.0", api.GoModReplaceUpstreamPackageVersion, "")
+	managedPackage := replace("example.com/x", "example.com/x", "v1.2.0", api.GoModReplacePriorityManagedPackage, "")
+	local := replace("example.com/x", "../x", "", api.GoModReplacePriorityLocal, "")
+
+	for _, tc := range []struct {
+		name     string
+		replaces []api.GoModReplace
+		want     string
+	}{
+		{
+			name:     "ascending",
+			replaces: []api.GoModReplace{upstreamReplace, upstreamVersion, managedPackage},
+			want:     "example.com/x => example.com/x v1.2.0",
+		},
+		{
+			name:     "descending",
+			replaces: []api.GoModReplace{managedPackage, upstreamVersion, upstreamReplace},
+			want:     "example.com/x => example.com/x v1.2.0",
+		},
+		{
+			name:     "highest in the middle",
+			replaces: []api.GoModReplace{upstreamVersion, managedPackage, upstreamReplace},
+			want:     "example.com/x => example.com/x v1.2.0",
+		},
+		{
+			name:     "without managed package",
+			replaces: []api.GoModReplace{upstreamVersion, upstreamReplace},
+			want:     "example.com/x => example.com/x v1.1.0",
+		},
+		{
+			name:     "local wins",
+			replaces: []api.GoModReplace{local, managedPackage, upstreamVersion, upstreamReplace},
+			want:     "example.com/x => ../x ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newTestGoMod(t, "module example.com/app\n\ngo 1.15\n")
+			for _, r := range tc.replaces {
+				if err := g.AddReplace(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := replacesOf(t, g)
+			if len(got) != 1 || got[0] != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestReplaceCommentsPreserved(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		comment string
+		want    string
+	}{
+		{
+			name:    "managed comment updated",
+			comment: "pinned version from example.com/other",
+			want: `	// keep until upstream is fixed
+	// [go-mod-promote] pinned version from example.com/other
+	example.com/x => example.com/x v1.1.0
+`,
+		},
+		{
+			name: "managed comment removed",
+			want: `	// keep until upstream is fixed
+	example.com/x => example.com/x v1.1.0
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newTestGoMod(t, `module example.com/app
+
+go 1.15
+
+replace (
+	// keep until upstream is fixed
+	// [go-mod-promote] pinned version from example.com/up
+	example.com/x => example.com/x v1.0.0
+	example.com/y => example.com/y v1.0.0
+)
+`)
+			if err := g.AddReplace(replace("example.com/x", "example.com/x", "v1.1.0", api.GoModReplacePriorityManagedPackage, tc.comment)); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := g.format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), tc.want) {
+				t.Errorf("expected go.mod to contain:\n%s\ngot:\n%s", tc.want, data)
+			}
+		})
+	}
+}
+
+func TestWithManagedComment(t *testing.T) {
+	const token = managedCommentPrefix + " new"
+	for _, tc := range []struct {
+		name     string
+		comments []string
+		want     []string
+	}{
+		{name: "no comments", want: []string{token}},
+		{
+			name:     "human comment",
+			comments: []string{"// human"},
+			want:     []string{"// human", token},
+		},
+		{
+			name:     "managed comment replaced in place",
+			comments: []string{"// before", managedCommentPrefix + " old", "// after"},
+			want:     []string{"// before", token, "// after"},
+		},
+		{
+			name:     "duplicate managed comments collapsed",
+			comments: []string{managedCommentPrefix + " old", managedCommentPrefix + " older"},
+			want:     []string{token},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var comments []modfile.Comment
+			for _, c := range tc.comments {
+				comments = append(comments, modfile.Comment{Token: c})
+			}
+
+			var got []string
+			for _, c := range withManagedComment(comments, token) {
+				got = append(got, c.Token)
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRaiseGoVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		goMod   string
+		version string
+		want    string
+		wantErr bool
+	}{
+		{name: "raise", goMod: "go 1.15\n", version: "1.16", want: "1.16"},
+		{name: "raise to release with patch zero", goMod: "go 1.15\n", version: "1.21.0", want: "1.21"},
+		{name: "raise without go directive", version: "1.16", want: "1.16"},
+		{name: "never lower", goMod: "go 1.16\n", version: "1.15", want: "1.16"},
+		{name: "equal", goMod: "go 1.21\n", version: "1.21.0", want: "1.21"},
+		{name: "lower patch release", goMod: "go 1.21\n", version: "1.20.5", want: "1.21"},
+		{name: "patch release", goMod: "go 1.15\n", version: "1.21.1", wantErr: true},
+		{name: "release candidate", goMod: "go 1.15\n", version: "1.21rc1", wantErr: true},
+		{name: "invalid", goMod: "go 1.15\n", version: "go1.21", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newTestGoMod(t, "module example.com/app\n\n"+tc.goMod)
+
+			err := g.RaiseGoVersion(tc.version)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got go %s", g.GoVersion())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := g.GoVersion(); got != tc.want {
+				t.Errorf("expected go %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestUnsupportedDirectives(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		goMod   string
+		wantErr string
+	}{
+		{name: "toolchain", goMod: "go 1.21\n\ntoolchain go1.21.5\n", wantErr: "toolchain directives are not supported"},
+		{name: "patch release", goMod: "go 1.21.0\n", wantErr: "go version '1.21.0' is not supported"},
+		{name: "release candidate", goMod: "go 1.21rc1\n", wantErr: "go version '1.21rc1' is not supported"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "go.mod")
+			if err := ioutil.WriteFile(path, []byte("module example.com/up\n\n"+tc.goMod), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewGoModFromPath(path)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
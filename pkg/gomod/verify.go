@@ -0,0 +1,74 @@
+package gomod
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+)
+
+var (
+	// verifyModifiedRE matches "<path> <version>: dir has been modified (...)"
+	verifyModifiedRE = regexp.MustCompile(`^(\S+) (\S+): ((?:dir|zip|go\.mod) has been modified.*|missing ziphash.*)$`)
+	// verifyMismatchRE matches "verifying <path>@<version>: checksum mismatch"
+	verifyMismatchRE = regexp.MustCompile(`^(?:go: )?verifying (\S+?)@(\S+?)(?:/go\.mod)?: (.+)$`)
+	// verifyMissingModuleRE matches "go: <path>@<version>: missing go.sum
+	// entry for go.mod file"
+	verifyMissingModuleRE = regexp.MustCompile(`^(?:go: )?(\S+?)@(\S+?): missing go\.sum entry`)
+	// verifyMissingRE matches "missing go.sum entry for module providing
+	// package <pkg>" as well as missing entries for go.mod files
+	verifyMissingRE = regexp.MustCompile(`missing go\.sum entry(?: for module providing package (\S+))?`)
+)
+
+// parseVerifyOutput extracts the failing modules from the output of go mod
+// verify.
+func parseVerifyOutput(output string) []gmperr.GoModVerifyFailure {
+	var failures []gmperr.GoModVerifyFailure
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := verifyModifiedRE.FindStringSubmatch(line); m != nil {
+			failures = append(failures, gmperr.GoModVerifyFailure{
+				Path:            m[1],
+				Version:         m[2],
+				Reason:          m[3],
+				DownloadMayHelp: true,
+			})
+			continue
+		}
+
+		if m := verifyMismatchRE.FindStringSubmatch(line); m != nil {
+			// a checksum mismatch against go.sum is not fixed by downloading
+			// the module again
+			failures = append(failures, gmperr.GoModVerifyFailure{
+				Path:    m[1],
+				Version: m[2],
+				Reason:  m[3],
+			})
+			continue
+		}
+
+		if m := verifyMissingModuleRE.FindStringSubmatch(line); m != nil {
+			failures = append(failures, gmperr.GoModVerifyFailure{
+				Path:            m[1],
+				Version:         m[2],
+				Reason:          "missing go.sum entry",
+				DownloadMayHelp: true,
+			})
+			continue
+		}
+
+		if m := verifyMissingRE.FindStringSubmatch(line); m != nil {
+			failures = append(failures, gmperr.GoModVerifyFailure{
+				Path:            m[1],
+				Reason:          "missing go.sum entry",
+				DownloadMayHelp: true,
+			})
+		}
+	}
+
+	return failures
+}
@@ -0,0 +1,136 @@
+package gomod
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+)
+
+const securityError = `
+SECURITY ERROR
+This download does NOT match an earlier download recorded in go.sum.
+The bits may have been replaced on the origin server, or an attacker may
+have intercepted the download attempt.
+
+For more information, see 'go help module-auth'.
+`
+
+func TestParseVerifyOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		want   []gmperr.GoModVerifyFailure
+	}{
+		{
+			name:   "dir modified",
+			output: "github.com/pkg/errors v0.9.1: dir has been modified (/root/go/pkg/mod/github.com/pkg/errors@v0.9.1)\n",
+			want: []gmperr.GoModVerifyFailure{{
+				Path:            "github.com/pkg/errors",
+				Version:         "v0.9.1",
+				Reason:          "dir has been modified (/root/go/pkg/mod/github.com/pkg/errors@v0.9.1)",
+				DownloadMayHelp: true,
+			}},
+		},
+		{
+			name: "checksum mismatch",
+			output: "verifying github.com/pkg/errors@v0.9.1: checksum mismatch\n" +
+				"\tdownloaded: h1:FEBLx1zS214owpjy7qsBeixbURkuhQAwrK5UwLGTwt4=\n" +
+				"\tgo.sum:     h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n" + securityError,
+			want: []gmperr.GoModVerifyFailure{{
+				Path:    "github.com/pkg/errors",
+				Version: "v0.9.1",
+				Reason:  "checksum mismatch",
+			}},
+		},
+		{
+			name: "go.mod checksum mismatch",
+			output: "verifying github.com/pkg/errors@v0.9.1/go.mod: checksum mismatch\n" +
+				"\tdownloaded: h1:bwawxfHBFNV+L2hUp1rHADufV3IMtnDRdf1r5NINEl0=\n" +
+				"\tgo.sum:     h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n" + securityError,
+			want: []gmperr.GoModVerifyFailure{{
+				Path:    "github.com/pkg/errors",
+				Version: "v0.9.1",
+				Reason:  "checksum mismatch",
+			}},
+		},
+		{
+			name: "missing entry of package",
+			output: "main.go:3:8: missing go.sum entry for module providing package github.com/pkg/errors (imported by example.com/app); to add:\n" +
+				"\tgo get example.com/app\n",
+			want: []gmperr.GoModVerifyFailure{{
+				Path:            "github.com/pkg/errors",
+				Reason:          "missing go.sum entry",
+				DownloadMayHelp: true,
+			}},
+		},
+		{
+			name: "missing entry of go.mod file",
+			output: "go: github.com/pkg/errors@v0.9.1: missing go.sum entry for go.mod file; to add it:\n" +
+				"\tgo mod download github.com/pkg/errors\n",
+			want: []gmperr.GoModVerifyFailure{{
+				Path:            "github.com/pkg/errors",
+				Version:         "v0.9.1",
+				Reason:          "missing go.sum entry",
+				DownloadMayHelp: true,
+			}},
+		},
+		{
+			name: "multiple failures",
+			output: "github.com/pkg/errors v0.9.1: dir has been modified (/root/go/pkg/mod/github.com/pkg/errors@v0.9.1)\n" +
+				"golang.org/x/mod v0.4.1: missing ziphash: open /root/go/pkg/mod/cache/download/golang.org/x/mod/@v/v0.4.1.ziphash: no such file or directory\n",
+			want: []gmperr.GoModVerifyFailure{
+				{
+					Path:            "github.com/pkg/errors",
+					Version:         "v0.9.1",
+					Reason:          "dir has been modified (/root/go/pkg/mod/github.com/pkg/errors@v0.9.1)",
+					DownloadMayHelp: true,
+				},
+				{
+					Path:            "golang.org/x/mod",
+					Version:         "v0.4.1",
+					Reason:          "missing ziphash: open /root/go/pkg/mod/cache/download/golang.org/x/mod/@v/v0.4.1.ziphash: no such file or directory",
+					DownloadMayHelp: true,
+				},
+			},
+		},
+		{
+			name:   "unknown output",
+			output: "go: github.com/pkg/errors@v0.9.1: module lookup disabled by GOPROXY=off\n",
+		},
+		{
+			name:   "verified",
+			output: "all modules verified\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseVerifyOutput(tc.output)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestErrGoModVerify(t *testing.T) {
+	output := "verifying github.com/pkg/errors@v0.9.1: checksum mismatch\n" + securityError
+	err := gmperr.ErrGoModVerify{
+		Command:  []string{"go", "mod", "verify"},
+		Failures: parseVerifyOutput(output),
+		Output:   output,
+		Err:      errors.New("exit status 1"),
+	}
+
+	want := "error verifying module with [go mod verify]: github.com/pkg/errors@v0.9.1: checksum mismatch: exit status 1"
+	if err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+
+	// without parsed failures the whole output is kept
+	err.Failures = parseVerifyOutput("unexpected output")
+	if !strings.Contains(err.Error(), "SECURITY ERROR") {
+		t.Errorf("expected the output in the error, got %q", err.Error())
+	}
+}
@@ -0,0 +1,114 @@
+// Package metrics exposes prometheus metrics about go-mod-promote runs.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "go_mod_promote"
+
+// Metrics holds the prometheus metrics of runs. All methods are no-ops on a
+// nil Metrics, so recording them is optional.
+type Metrics struct {
+	packages     *prometheus.CounterVec
+	patches      *prometheus.CounterVec
+	pullRequests prometheus.Counter
+	runDuration  prometheus.Histogram
+}
+
+// New creates the metrics and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		packages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "packages_total",
+			Help:      "Number of packages processed by state (considered, updated, skipped, failed).",
+		}, []string{"state"}),
+		patches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "patches_total",
+			Help:      "Number of patches by result (applied, rejected).",
+		}, []string{"result"}),
+		pullRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pull_requests_created_total",
+			Help:      "Number of pull requests created.",
+		}),
+		runDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "run_duration_seconds",
+			Help:      "Duration of runs.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+	}
+
+	reg.MustRegister(m.packages, m.patches, m.pullRequests, m.runDuration)
+
+	return m
+}
+
+// PackageConsidered counts a package that has been looked at
+func (m *Metrics) PackageConsidered() {
+	if m == nil {
+		return
+	}
+	m.packages.WithLabelValues("considered").Inc()
+}
+
+// PackageUpdated counts a package that has been updated
+func (m *Metrics) PackageUpdated() {
+	if m == nil {
+		return
+	}
+	m.packages.WithLabelValues("updated").Inc()
+}
+
+// PackageSkipped counts a package that required no update
+func (m *Metrics) PackageSkipped() {
+	if m == nil {
+		return
+	}
+	m.packages.WithLabelValues("skipped").Inc()
+}
+
+// PackageFailed counts a package that failed to update
+func (m *Metrics) PackageFailed() {
+	if m == nil {
+		return
+	}
+	m.packages.WithLabelValues("failed").Inc()
+}
+
+// PatchesApplied counts applied patches
+func (m *Metrics) PatchesApplied(n int) {
+	if m == nil {
+		return
+	}
+	m.patches.WithLabelValues("applied").Add(float64(n))
+}
+
+// PatchesRejected counts rejected patches
+func (m *Metrics) PatchesRejected(n int) {
+	if m == nil {
+		return
+	}
+	m.patches.WithLabelValues("rejected").Add(float64(n))
+}
+
+// PullRequestCreated counts a created pull request
+func (m *Metrics) PullRequestCreated() {
+	if m == nil {
+		return
+	}
+	m.pullRequests.Inc()
+}
+
+// ObserveRunDuration records the duration of a run
+func (m *Metrics) ObserveRunDuration(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.runDuration.Observe(d.Seconds())
+}
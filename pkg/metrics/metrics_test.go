@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+
+	m.PackageConsidered()
+	m.PackageConsidered()
+	m.PackageUpdated()
+	m.PackageSkipped()
+	m.PackageFailed()
+	m.PatchesApplied(3)
+	m.PatchesRejected(1)
+	m.PullRequestCreated()
+	m.ObserveRunDuration(5 * time.Second)
+
+	for _, tc := range []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{name: "considered", collector: m.packages.WithLabelValues("considered"), want: 2},
+		{name: "updated", collector: m.packages.WithLabelValues("updated"), want: 1},
+		{name: "skipped", collector: m.packages.WithLabelValues("skipped"), want: 1},
+		{name: "failed", collector: m.packages.WithLabelValues("failed"), want: 1},
+		{name: "patches applied", collector: m.patches.WithLabelValues("applied"), want: 3},
+		{name: "patches rejected", collector: m.patches.WithLabelValues("rejected"), want: 1},
+		{name: "pull requests", collector: m.pullRequests, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(tc.collector); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, family := range families {
+		if family.GetName() != "go_mod_promote_run_duration_seconds" {
+			continue
+		}
+		found = true
+		h := family.GetMetric()[0].GetHistogram()
+		if h.GetSampleCount() != 1 || h.GetSampleSum() != 5 {
+			t.Errorf("expected a single run of 5s, got %d runs of %vs", h.GetSampleCount(), h.GetSampleSum())
+		}
+	}
+	if !found {
+		t.Error("run duration not registered")
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+
+	// recording on nil metrics must not panic
+	m.PackageConsidered()
+	m.PackageUpdated()
+	m.PackageSkipped()
+	m.PackageFailed()
+	m.PatchesApplied(1)
+	m.PatchesRejected(1)
+	m.PullRequestCreated()
+	m.ObserveRunDuration(time.Second)
+}
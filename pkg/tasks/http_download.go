@@ -0,0 +1,171 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+)
+
+const httpDownloadDefaultTimeout = time.Minute
+
+// TaskHTTPDownload fetches a file from a URL and writes it to the
+// destination. Downloads failing with network errors or server side failures
+// are retried like the go and git commands depending on the network.
+type TaskHTTPDownload struct {
+	URL string `yaml:"url" json:"url"`
+	// Destination is the path of the downloaded file relative to the root
+	Destination string `yaml:"destination" json:"destination"`
+	// SHA256 is the expected hex encoded digest of the downloaded content, it
+	// is not verified if empty.
+	SHA256 string `yaml:"sha256" json:"sha256"`
+	// If IfChanged is set to true, the file is only copied, when the
+	// downloaded content differs from the destination.
+	IfChanged bool `yaml:"if_changed" json:"if_changed"`
+	// Timeout limits every attempt of the download, e.g. "30s". Defaults to
+	// one minute.
+	Timeout string `yaml:"timeout" json:"timeout"`
+}
+
+func (t *TaskHTTPDownload) timeout() (time.Duration, error) {
+	if t.Timeout == "" {
+		return httpDownloadDefaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(t.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout of http_download: %w", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout of http_download must be positive, got %s", t.Timeout)
+	}
+	return timeout, nil
+}
+
+func (t *TaskHTTPDownload) run(ctx context.Context) (*Result, error) {
+	rootPath, err := gmpctx.RootPathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url of http_download: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url '%s' of http_download needs to use http or https", t.URL)
+	}
+	if t.Destination == "" {
+		return nil, fmt.Errorf("destination of http_download is empty")
+	}
+	timeout, err := t.timeout()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := httpDownload(ctx, t.URL, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.SHA256 != "" {
+		digest := sha256.Sum256(content)
+		if actual := hex.EncodeToString(digest[:]); !strings.EqualFold(actual, t.SHA256) {
+			return nil, gmperr.ErrChecksumMismatch{Path: t.URL, Expected: t.SHA256, Actual: actual}
+		}
+	}
+
+	if t.IfChanged {
+		existing, err := ioutil.ReadFile(filepath.Join(rootPath, t.Destination))
+		if err == nil && bytes.Equal(existing, content) {
+			level.Debug(gmpctx.LoggerFromContext(ctx)).Log("msg", "downloaded file unchanged", "url", t.URL, "destination", t.Destination)
+			return &Result{}, nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	downloadedFile, err := ioutil.TempFile(gmpctx.TempDirFromContext(ctx), "http_download")
+	if err != nil {
+		return nil, err
+	}
+	defer downloadedFile.Close()
+
+	if _, err := downloadedFile.Write(content); err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		FilesToCopy: []Copy{{
+			Source:      downloadedFile.Name(),
+			Destination: t.Destination,
+		}},
+	}, nil
+}
+
+// httpDownload fetches the content of the url, it retries on network errors
+// and server side failures with the network retry policy of the context.
+func httpDownload(ctx context.Context, u string, timeout time.Duration) ([]byte, error) {
+	logger := gmpctx.LoggerFromContext(ctx)
+	policy := gmpctx.NetworkRetryFromContext(ctx)
+
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		content, retry, err := httpGet(ctx, u, timeout)
+		if err == nil || !retry || attempt >= policy.Attempts {
+			return content, err
+		}
+
+		level.Warn(logger).Log("msg", "retrying failed download", "url", u, "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// httpGet fetches the content of the url once, retry is true if the failure
+// might be transient.
+func httpGet(ctx context.Context, u string, timeout time.Duration) (content []byte, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("error downloading '%s': %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// drain the body, so the connection can be reused
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("error downloading '%s': unexpected status %s", u, resp.Status)
+	}
+
+	content, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("error downloading '%s': %w", u, err)
+	}
+	return content, false, nil
+}
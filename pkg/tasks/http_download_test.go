@@ -0,0 +1,145 @@
+package tasks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+)
+
+// downloadServer serves the content after failing the given number of
+// requests with the status.
+func downloadServer(t *testing.T, content string, failures int32, status int) (srv *httptest.Server, requests *int32) {
+	t.Helper()
+	requests = new(int32)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+// downloadContext returns a context for http_download tasks, which retries
+// downloads without waiting long.
+func downloadContext(t *testing.T, root map[string]string) (ctx context.Context, rootPath string) {
+	t.Helper()
+	ctx, _, rootPath = testContext(t, nil, root)
+	ctx = gmpctx.TempDirIntoContext(ctx, t.TempDir())
+	ctx = gmpctx.NetworkRetryIntoContext(ctx, api.NetworkRetry{Attempts: 3, Backoff: time.Millisecond})
+	return ctx, rootPath
+}
+
+func TestHTTPDownloadRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		failures     int32
+		status       int
+		wantErr      bool
+		wantRequests int32
+	}{
+		{name: "success", wantRequests: 1},
+		{name: "server error retried", failures: 2, status: http.StatusBadGateway, wantRequests: 3},
+		{name: "too many requests retried", failures: 1, status: http.StatusTooManyRequests, wantRequests: 2},
+		{name: "attempts exhausted", failures: 3, status: http.StatusServiceUnavailable, wantErr: true, wantRequests: 3},
+		{name: "not found not retried", failures: 1, status: http.StatusNotFound, wantErr: true, wantRequests: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, requests := downloadServer(t, "content", tc.failures, tc.status)
+			ctx, rootPath := downloadContext(t, nil)
+
+			result, err := (&TaskHTTPDownload{URL: srv.URL, Destination: "new/dir/file"}).run(ctx)
+			if got := atomic.LoadInt32(requests); got != tc.wantRequests {
+				t.Errorf("expected %d requests, got %d", tc.wantRequests, got)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the destination is within a directory, which doesn't exist yet
+			if err := result.Apply(ctx); err != nil {
+				t.Fatalf("error applying download: %v", err)
+			}
+			if got := readFile(t, filepath.Join(rootPath, "new/dir/file")); got != "content" {
+				t.Errorf("unexpected content %q", got)
+			}
+		})
+	}
+}
+
+func TestHTTPDownloadSHA256(t *testing.T) {
+	digest := sha256.Sum256([]byte("content"))
+	for _, tc := range []struct {
+		name    string
+		sha256  string
+		wantErr bool
+	}{
+		{name: "match", sha256: hex.EncodeToString(digest[:])},
+		{name: "match ignoring case", sha256: "ED7002B439E9AC845F22357D822BAC1444730FBDB6016D3EC9432297B9EC9F73"},
+		{name: "mismatch", sha256: hex.EncodeToString(make([]byte, sha256.Size)), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := downloadServer(t, "content", 0, 0)
+			ctx, _ := downloadContext(t, nil)
+
+			_, err := (&TaskHTTPDownload{URL: srv.URL, Destination: "file", SHA256: tc.sha256}).run(ctx)
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var mismatchErr gmperr.ErrChecksumMismatch
+			if !errors.As(err, &mismatchErr) {
+				t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+			}
+			if mismatchErr.Actual != hex.EncodeToString(digest[:]) {
+				t.Errorf("unexpected actual digest %s", mismatchErr.Actual)
+			}
+		})
+	}
+}
+
+func TestHTTPDownloadIfChanged(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		ifChanged  bool
+		existing   map[string]string
+		wantCopies []string
+	}{
+		{name: "unchanged", ifChanged: true, existing: map[string]string{"file": "content"}},
+		{name: "changed", ifChanged: true, existing: map[string]string{"file": "outdated"}, wantCopies: []string{"file"}},
+		{name: "missing", ifChanged: true, wantCopies: []string{"file"}},
+		{name: "disabled", existing: map[string]string{"file": "content"}, wantCopies: []string{"file"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := downloadServer(t, "content", 0, 0)
+			ctx, _ := downloadContext(t, tc.existing)
+
+			result, err := (&TaskHTTPDownload{URL: srv.URL, Destination: "file", IfChanged: tc.ifChanged}).run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectChanges(t, result, tc.wantCopies, nil)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+func isTransient(err error, names []string) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+
+	for _, name := range names {
+		if e, ok := api.FSRetryErrnos[name]; ok && e == errno {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryPolicy returns the configured retry policy, unset fields fall back to
+// the defaults.
+func retryPolicy(ctx context.Context) api.FSRetry {
+	policy := gmpctx.FSRetryFromContext(ctx)
+
+	if policy.Attempts <= 0 {
+		policy.Attempts = api.DefaultFSRetry.Attempts
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = api.DefaultFSRetry.Backoff
+	}
+	if policy.Errors == nil {
+		policy.Errors = api.DefaultFSRetry.Errors
+	}
+	return policy
+}
+
+// retryFS runs a filesystem operation and retries it with an exponential
+// backoff, as long as it fails with an error considered transient.
+func retryFS(ctx context.Context, op func() error) error {
+	logger := gmpctx.LoggerFromContext(ctx)
+	policy := retryPolicy(ctx)
+
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= policy.Attempts || !isTransient(err, policy.Errors) {
+			return err
+		}
+
+		level.Debug(logger).Log("msg", "retrying after transient filesystem error", "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
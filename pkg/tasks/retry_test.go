@@ -0,0 +1,62 @@
+package tasks
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+func TestRetryFS(t *testing.T) {
+	policy := api.FSRetry{Attempts: 3, Backoff: time.Millisecond, Errors: []string{"EAGAIN"}}
+
+	for _, tc := range []struct {
+		name         string
+		err          error
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "success", wantAttempts: 1},
+		{name: "transient error recovers", err: &os.PathError{Op: "open", Path: "file", Err: syscall.EAGAIN}, failures: 2, wantAttempts: 3},
+		{name: "transient error exceeds attempts", err: &os.PathError{Op: "open", Path: "file", Err: syscall.EAGAIN}, failures: 5, wantAttempts: 3, wantErr: true},
+		{name: "errno not configured", err: &os.PathError{Op: "open", Path: "file", Err: syscall.EBUSY}, failures: 5, wantAttempts: 1, wantErr: true},
+		{name: "permanent error", err: &os.PathError{Op: "open", Path: "file", Err: syscall.ENOENT}, failures: 5, wantAttempts: 1, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := gmpctx.FSRetryIntoContext(context.Background(), policy)
+
+			attempts := 0
+			err := retryFS(ctx, func() error {
+				attempts++
+				if attempts <= tc.failures {
+					return tc.err
+				}
+				return nil
+			})
+			if tc.wantErr && err == nil {
+				t.Fatal("expected an error")
+			} else if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if attempts != tc.wantAttempts {
+				t.Errorf("expected %d attempts, got %d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestRetryFSDefaults(t *testing.T) {
+	attempts := 0
+	_ = retryFS(context.Background(), func() error {
+		attempts++
+		return &os.PathError{Op: "open", Path: "file", Err: syscall.EBUSY}
+	})
+	if attempts != api.DefaultFSRetry.Attempts {
+		t.Errorf("expected %d attempts, got %d", api.DefaultFSRetry.Attempts, attempts)
+	}
+}
@@ -7,13 +7,20 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/hashicorp/go-multierror"
 	"golang.org/x/mod/modfile"
@@ -28,21 +35,222 @@ import (
 
 type Patch struct {
 	Body []byte
+
+	// Fuzz sets the maximum fuzz factor used by patch, if not set the default
+	// of patch is used.
+	Fuzz *int
+
+	// If ThreeWay is set to true and patch would reject hunks, git apply
+	// --3way is used instead. In that case the result of git apply wins, even
+	// if it leaves conflicts behind.
+	ThreeWay bool
+
+	// Backend selects the tool applying the patch, it defaults to patch.
+	Backend PatchBackend
+
+	// NoContext is set for patches without context lines, git apply only
+	// accepts them with --unidiff-zero.
+	NoContext bool
+}
+
+// PatchBackend is the tool used to apply patches
+type PatchBackend string
+
+const (
+	PatchBackendDefault = PatchBackend("")
+	PatchBackendPatch   = PatchBackend("patch")
+	// PatchBackendGit uses git apply, which supports renames and binary
+	// diffs in the git format
+	PatchBackendGit = PatchBackend("git")
+)
+
+type PatchError = gmperr.ErrPatchRejected
+
+// rootPath returns the root path of the context, patches are relative to it.
+// If it is not set, the working directory of the process is used.
+func rootPath(ctx context.Context) string {
+	v, _ := gmpctx.RootPathFromContextOrError(ctx)
+	return v
+}
+
+// inRootPath resolves a path relative to the root path, so it doesn't depend
+// on the working directory of the process.
+func inRootPath(ctx context.Context, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(rootPath(ctx), path)
+}
+
+func (p *Patch) patchArgs() []string {
+	args := []string{
+		"--strip", "1", // remove the first directory of the patch paths
+		"--no-backup-if-mismatch", // avoid backing up the original files
+	}
+	if p.Fuzz != nil {
+		args = append(args, "--fuzz", strconv.Itoa(*p.Fuzz))
+	}
+	return args
+}
+
+// wouldReject runs patch in dry-run mode to figure out if hunks would be
+// rejected.
+func (p *Patch) wouldReject(ctx context.Context) (bool, error) {
+	c := command.New(ctx, "patch", append(p.patchArgs(), "--dry-run")...).WithDir(rootPath(ctx))
+	c.Stdin = bytes.NewReader(p.Body)
+	if err := c.Run(); err != nil {
+		if c.ExitCode == 1 {
+			return true, nil
+		}
+		return false, fmt.Errorf("error testing patch: %w stdout=[%s] stderr=[%s]", err, c.Stdout.String(), c.Stderr.String())
+	}
+	return false, nil
+}
+
+// gitApplyArgs returns the arguments of git apply for the patch.
+func (p *Patch) gitApplyArgs(args ...string) []string {
+	args = append([]string{"apply", "-p1"}, args...)
+	if p.NoContext {
+		args = append(args, "--unidiff-zero")
+	}
+	return args
+}
+
+func (p *Patch) applyGit3Way(ctx context.Context) error {
+	c := command.New(ctx, "git", p.gitApplyArgs("--3way")...).WithDir(rootPath(ctx))
+	c.Stdin = bytes.NewReader(p.Body)
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("error applying patch using git apply --3way: %w stdout=[%s] stderr=[%s]", err, c.Stdout.String(), c.Stderr.String())
+	}
+	return nil
+}
+
+// targets returns the paths of the existing files the patch modifies, with the
+// first directory stripped. Files created by the patch are not included.
+func (p *Patch) targets() []string {
+	var targets []string
+	var previous string
+	scanner := bufio.NewScanner(bytes.NewReader(p.Body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// a file header is a --- line directly followed by a +++ line,
+		// removed lines starting with "-- " look the same otherwise
+		header := previous
+		previous = line
+		if !strings.HasPrefix(line, "+++ ") || !strings.HasPrefix(header, "--- ") {
+			continue
+		}
+
+		// the path is terminated by a tab, if followed by a timestamp
+		path := strings.TrimPrefix(header, "--- ")
+		if pos := strings.IndexByte(path, '\t'); pos >= 0 {
+			path = path[:pos]
+		}
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			path = unquoted
+		}
+		if path == "/dev/null" {
+			continue
+		}
+		if pos := strings.IndexByte(path, '/'); pos >= 0 {
+			path = path[pos+1:]
+		}
+		targets = append(targets, path)
+	}
+	return targets
 }
 
-type PatchError struct {
-	Upstream error
-	Reject   []byte
-	msg      string
+// checkTargets returns an error, if a file modified by the patch is missing.
+func (p *Patch) checkTargets(ctx context.Context) error {
+	for _, target := range p.targets() {
+		exists, err := fileExists(filepath.Join(rootPath(ctx), target))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return gmperr.ErrPatchTargetMissing{Path: target}
+		}
+	}
+	return nil
 }
 
-func (p *PatchError) Error() string {
-	return p.msg
+// applyGit applies the patch using git apply. If that fails, the patch is
+// either applied using git apply --3way or the hunks that apply are applied
+// and the rejected ones returned.
+func (p *Patch) applyGit(ctx context.Context) error {
+	c := command.New(ctx, "git", p.gitApplyArgs()...).WithDir(rootPath(ctx))
+	c.Stdin = bytes.NewReader(p.Body)
+	if err := c.Run(); err == nil {
+		return nil
+	}
+
+	if p.ThreeWay {
+		level.Info(gmpctx.LoggerFromContext(ctx)).Log("msg", "git apply failed, using git apply --3way instead")
+		return p.applyGit3Way(ctx)
+	}
+
+	c = command.New(ctx, "git", p.gitApplyArgs("--reject")...).WithDir(rootPath(ctx))
+	c.Stdin = bytes.NewReader(p.Body)
+	err := c.Run()
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("error applying patch using git apply: %w stdout=[%s] stderr=[%s]", err, c.Stdout.String(), c.Stderr.String())
+
+	// git apply --reject writes the rejected hunks next to the targets
+	var reject []byte
+	for _, target := range p.targets() {
+		rejectPath := filepath.Join(rootPath(ctx), target+".rej")
+		rejectBody, rerr := ioutil.ReadFile(rejectPath)
+		if os.IsNotExist(rerr) {
+			continue
+		} else if rerr != nil {
+			return err
+		}
+		reject = append(reject, rejectBody...)
+		if rerr := os.Remove(rejectPath); rerr != nil {
+			return err
+		}
+	}
+
+	if len(reject) == 0 {
+		return err
+	}
+
+	return &PatchError{
+		Upstream: err,
+		Reject:   reject,
+		Output:   c.Stderr.String(),
+	}
 }
 
 func (p *Patch) Apply(ctx context.Context) error {
 	logger := gmpctx.LoggerFromContext(ctx)
 
+	if err := p.checkTargets(ctx); err != nil {
+		return err
+	}
+
+	switch p.Backend {
+	case PatchBackendDefault, PatchBackendPatch:
+		// applied with patch below
+	case PatchBackendGit:
+		return p.applyGit(ctx)
+	default:
+		return fmt.Errorf("unknown patch backend '%s'", p.Backend)
+	}
+
+	if p.ThreeWay {
+		reject, err := p.wouldReject(ctx)
+		if err != nil {
+			return err
+		}
+		if reject {
+			level.Info(logger).Log("msg", "patch would reject hunks, using git apply --3way instead")
+			return p.applyGit3Way(ctx)
+		}
+	}
+
 	rejectFile, err := ioutil.TempFile("", "reject")
 	if err != nil {
 		return err
@@ -52,11 +260,9 @@ func (p *Patch) Apply(ctx context.Context) error {
 		return err
 	}
 
-	c := command.New(ctx, "patch",
-		"--strip", "1", // remove the first directory of the patch paths
+	c := command.New(ctx, "patch", append(p.patchArgs(),
 		"--reject-file", rejectFile.Name(), // if patch doesn't apply, parts that did not work are stored there
-		"--no-backup-if-mismatch", // avoid backing up the original files
-	)
+	)...).WithDir(rootPath(ctx))
 	stdin, err := c.StdinPipe()
 	if err != nil {
 		return err
@@ -89,7 +295,7 @@ func (p *Patch) Apply(ctx context.Context) error {
 			return &PatchError{
 				Upstream: err,
 				Reject:   rejectBody,
-				msg:      c.Stdout.String(),
+				Output:   c.Stdout.String(),
 			}
 
 		}
@@ -99,12 +305,67 @@ func (p *Patch) Apply(ctx context.Context) error {
 	return nil
 }
 
+// copyProgressThreshold is the file size above which the progress of a copy
+// is logged every copyProgressInterval bytes.
+const (
+	copyProgressThreshold = 64 << 20
+	copyProgressInterval  = 64 << 20
+)
+
 type Copy struct {
 	Source      string
 	Destination string // relative path to root
+	MaxSize     int64  // maximum size of the source in bytes, if > 0
+	// FollowSymlinks copies the content of symlinked files, otherwise the
+	// symlink itself is recreated at the destination
+	FollowSymlinks bool
+	// Diff is a unified diff from the destination to the source, it is only
+	// set if a preview was requested
+	Diff string
+	// LineEnding converts the line endings of text files to the given one,
+	// if set
+	LineEnding string
+	// ExpectedSHA256 is the hex encoded digest the source content has to
+	// match, if set
+	ExpectedSHA256 string
 }
 
 func (c *Copy) Apply(ctx context.Context) error {
+	resolved := *c
+	resolved.Destination = inRootPath(ctx, c.Destination)
+	return retryFS(ctx, func() error {
+		return resolved.apply(ctx)
+	})
+}
+
+func (c *Copy) apply(ctx context.Context) error {
+	if c.ExpectedSHA256 != "" {
+		if err := verifySHA256(ctx, c.Source, c.ExpectedSHA256); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.Destination), 0755); err != nil {
+		return err
+	}
+
+	// never write through an existing symlink at the destination
+	if destinationStat, err := os.Lstat(c.Destination); err == nil && destinationStat.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(c.Destination); err != nil {
+			return err
+		}
+	}
+
+	if !c.FollowSymlinks {
+		sourceLinkStat, err := os.Lstat(c.Source)
+		if err != nil {
+			return err
+		}
+		if sourceLinkStat.Mode()&os.ModeSymlink != 0 {
+			return c.applySymlink()
+		}
+	}
+
 	sourceFileStat, err := os.Stat(c.Source)
 	if err != nil {
 		return err
@@ -114,6 +375,22 @@ func (c *Copy) Apply(ctx context.Context) error {
 		return fmt.Errorf("%s is not a regular file", c.Source)
 	}
 
+	if c.MaxSize > 0 && sourceFileStat.Size() > c.MaxSize {
+		return fmt.Errorf("%s exceeds the maximum file size of %d bytes with %d bytes", c.Source, c.MaxSize, sourceFileStat.Size())
+	}
+
+	if c.LineEnding != "" {
+		return c.applyLineEnding(ctx)
+	}
+
+	// skip writing the destination, if the content is identical already
+	if unchanged, err := sameContent(c.Source, sourceFileStat, c.Destination); err != nil {
+		return err
+	} else if unchanged {
+		level.Debug(gmpctx.LoggerFromContext(ctx)).Log("msg", "destination is identical already", "source", c.Source, "destination", c.Destination)
+		return nil
+	}
+
 	source, err := os.Open(c.Source)
 	if err != nil {
 		return err
@@ -125,36 +402,250 @@ func (c *Copy) Apply(ctx context.Context) error {
 		return err
 	}
 	defer destination.Close()
-	_, err = io.Copy(destination, source)
-	return err
+
+	var reader io.Reader = source
+	if c.MaxSize > 0 {
+		// guard against the source growing while being copied
+		reader = io.LimitReader(source, c.MaxSize+1)
+	}
+
+	var writer io.Writer = destination
+	if sourceFileStat.Size() > copyProgressThreshold {
+		writer = &progressWriter{
+			Writer: destination,
+			logger: log.With(gmpctx.LoggerFromContext(ctx), "source", c.Source, "total_bytes", sourceFileStat.Size()),
+		}
+	}
+
+	written, err := io.Copy(writer, reader)
+	if err != nil {
+		return err
+	}
+	if c.MaxSize > 0 && written > c.MaxSize {
+		destination.Close()
+		os.Remove(c.Destination)
+		return fmt.Errorf("%s exceeds the maximum file size of %d bytes", c.Source, c.MaxSize)
+	}
+
+	return nil
+}
+
+// applyLineEnding copies the source with its line endings converted.
+func (c *Copy) applyLineEnding(ctx context.Context) error {
+	data, err := ioutil.ReadFile(c.Source)
+	if err != nil {
+		return err
+	}
+	if !isBinary(data) {
+		data = convertLineEndings(data, c.LineEnding)
+	}
+
+	if existing, err := ioutil.ReadFile(c.Destination); err == nil && bytes.Equal(existing, data) {
+		level.Debug(gmpctx.LoggerFromContext(ctx)).Log("msg", "destination is identical already", "source", c.Source, "destination", c.Destination)
+		return nil
+	}
+
+	return ioutil.WriteFile(c.Destination, data, 0644)
+}
+
+// isBinary detects binary content like git does, by looking for a NUL byte in
+// the first 8000 bytes.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// convertLineEndings replaces all CRLF and LF line endings with ending.
+func convertLineEndings(data []byte, ending string) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if ending == "\n" {
+		return data
+	}
+	return bytes.ReplaceAll(data, []byte("\n"), []byte(ending))
+}
+
+// lineEndingOf returns CRLF, if the text file uses it, and LF otherwise. It is
+// empty for binary files.
+func lineEndingOf(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if isBinary(data) {
+		return "", nil
+	}
+	if bytes.Contains(data, []byte("\r\n")) {
+		return "\r\n", nil
+	}
+	return "\n", nil
+}
+
+// sameContent returns true, if the destination is a regular file with the same
+// content as the source.
+func sameContent(source string, sourceInfo os.FileInfo, destination string) (bool, error) {
+	destinationInfo, err := os.Lstat(destination)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !destinationInfo.Mode().IsRegular() || destinationInfo.Size() != sourceInfo.Size() {
+		return false, nil
+	}
+
+	sourceHash, err := hashFile(source, HashAlgoSHA256)
+	if err != nil {
+		return false, err
+	}
+	destinationHash, err := hashFile(destination, HashAlgoSHA256)
+	if err != nil {
+		return false, err
+	}
+	return sourceHash == destinationHash, nil
+}
+
+// applySymlink recreates the symlink of the source at the destination.
+func (c *Copy) applySymlink() error {
+	target, err := os.Readlink(c.Source)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(c.Destination); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Symlink(target, c.Destination)
+}
+
+// progressWriter logs the number of bytes written every copyProgressInterval
+type progressWriter struct {
+	io.Writer
+	logger  log.Logger
+	written int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	before := w.written
+	w.written += int64(n)
+	if before/copyProgressInterval != w.written/copyProgressInterval {
+		level.Info(w.logger).Log("msg", "copy in progress", "written_bytes", w.written)
+	}
+	return n, err
 }
 
 type Delete string
 
+// Apply removes the file or symlink. A file that doesn't exist anymore, e.g.
+// because a patch already removed it, is not an error.
 func (d Delete) Apply(ctx context.Context) error {
-	filePath := string(d)
-	fileStat, err := os.Stat(filePath)
-	if err != nil {
+	return retryFS(ctx, func() error {
+		return d.apply(ctx)
+	})
+}
+
+func (d Delete) apply(ctx context.Context) error {
+	logger := log.With(gmpctx.LoggerFromContext(ctx), "path", string(d))
+
+	filePath := inRootPath(ctx, string(d))
+	fileStat, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		level.Debug(logger).Log("msg", "file to delete doesn't exist")
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	if !fileStat.Mode().IsRegular() {
-		return fmt.Errorf("%s is not a regular file", filePath)
+	if fileStat.Mode()&os.ModeSymlink != 0 {
+		level.Debug(logger).Log("msg", "deleting symlink")
+	} else if !fileStat.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file or symlink", filePath)
 	}
 
 	return os.Remove(filePath)
 }
 
+// Rename moves a file within the destination tree using git mv, so its
+// history is preserved. Both paths are relative to the root.
+type Rename struct {
+	From string
+	To   string
+}
+
+func (r *Rename) Apply(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(rootPath(ctx), r.To)), 0755); err != nil {
+		return err
+	}
+
+	c := command.New(ctx, "git", "mv", r.From, r.To).WithDir(rootPath(ctx))
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("error renaming '%s' to '%s': %w stderr=[%s]", r.From, r.To, err, c.Stderr.String())
+	}
+	return nil
+}
+
+// Generate runs go generate, after the files of all results have been copied
+// and patched.
+type Generate struct {
+	Dir      string            // absolute path the generator is run in
+	Packages []string          // package patterns passed to go generate
+	Env      map[string]string // additional environment variables
+}
+
+func (g *Generate) Apply(ctx context.Context) error {
+	c := command.New(ctx, "go", append([]string{"generate"}, g.Packages...)...).WithEnv(g.Env).WithDir(g.Dir)
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("error running go generate in '%s': %w stderr=[%s]", g.Dir, err, c.Stderr.String())
+	}
+	return nil
+}
+
+// Command runs an executable in the destination tree, after the files of all
+// results have been copied and patched.
+type Command struct {
+	Dir  string // absolute path the command is run in
+	Name string
+	Args []string
+}
+
+func (c *Command) Apply(ctx context.Context) error {
+	cmd := command.New(ctx, c.Name, c.Args...).WithDir(c.Dir)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running command '%s' in '%s': %w stdout=[%s] stderr=[%s]", c.Name, c.Dir, err, cmd.Stdout.String(), cmd.Stderr.String())
+	}
+	level.Debug(gmpctx.LoggerFromContext(ctx)).Log("msg", "command output", "command", c.Name, "stdout", cmd.Stdout.String(), "stderr", cmd.Stderr.String())
+	return nil
+}
+
 type Result struct {
+	FilesToRename []Rename
 	FilesToCopy   []Copy
 	FilesToDelete []Delete // relative path to root
 
 	Patches []Patch
 
 	Replaces []api.GoModReplace
+
+	Requires []module.Version
+
+	Excludes []module.Version
+
+	Generates []Generate
+
+	Commands []Command
+
+	// Checks run last and are expected to leave the files untouched, they
+	// don't make a result non-empty.
+	Checks []Command
 }
 
 func (r *Result) IsEmpty() bool {
+	if len(r.FilesToRename) > 0 {
+		return false
+	}
 	if len(r.FilesToCopy) > 0 {
 		return false
 	}
@@ -167,17 +658,56 @@ func (r *Result) IsEmpty() bool {
 	if len(r.Replaces) > 0 {
 		return false
 	}
+	if len(r.Requires) > 0 {
+		return false
+	}
+	if len(r.Excludes) > 0 {
+		return false
+	}
+	if len(r.Generates) > 0 {
+		return false
+	}
+	if len(r.Commands) > 0 {
+		return false
+	}
 
 	return true
 }
 
+// sort orders the files to copy and delete by their destination, so they are
+// applied in the same order on every run. Patches keep their order.
+func (r *Result) sort() {
+	sort.SliceStable(r.FilesToCopy, func(i, j int) bool {
+		return r.FilesToCopy[i].Destination < r.FilesToCopy[j].Destination
+	})
+	sort.SliceStable(r.FilesToDelete, func(i, j int) bool {
+		return r.FilesToDelete[i] < r.FilesToDelete[j]
+	})
+}
+
 func (r *Result) Apply(ctx context.Context) error {
 	logger := gmpctx.LoggerFromContext(ctx)
 
+	r.sort()
+
 	var result error
 
+	// rename first, so patches and copies apply to the new paths
+	for _, rename := range r.FilesToRename {
+		if err := rename.Apply(ctx); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		level.Info(logger).Log("msg", fmt.Sprintf("renamed '%s' to '%s' successfully", rename.From, rename.To))
+	}
+
 	for pos, patch := range r.Patches {
 		if err := patch.Apply(ctx); err != nil {
+			var patchErr *PatchError
+			if errors.As(err, &patchErr) {
+				patchErr.Patch = pos
+				level.Warn(logger).Log("msg", fmt.Sprintf("Patch[%d] partially failed to apply", pos), "rejects", string(patchErr.Reject))
+			}
 			result = multierror.Append(result, err)
 			continue
 		}
@@ -197,52 +727,266 @@ func (r *Result) Apply(ctx context.Context) error {
 			result = multierror.Append(result, err)
 			continue
 		}
-		level.Info(logger).Log("msg", fmt.Sprintf("copied '%s' successfully", toCopy))
+		level.Info(logger).Log("msg", fmt.Sprintf("copied '%s' to '%s' successfully", toCopy.Source, toCopy.Destination))
 	}
 
-	goModFile := gmpctx.GoModFileFromContext(ctx)
-	for _, replace := range r.Replaces {
-		if err := goModFile.AddReplace(replace); err != nil {
+	if err := r.ApplyGoMod(ctx); err != nil {
+		if merr, ok := err.(*multierror.Error); ok {
+			result = multierror.Append(result, merr.Errors...)
+		} else {
 			result = multierror.Append(result, err)
-			continue
 		}
 	}
 
 	return result
 }
 
-func AggregateResult(results ...*Result) *Result {
-	var aggregate Result
-	for _, r := range results {
-		if r == nil {
+// ApplyGoMod only applies the replaces, requires and excludes to the go.mod
+// of the context, which is written by its Finish. This allows to preview the
+// go.mod changes without touching any files.
+func (r *Result) ApplyGoMod(ctx context.Context) error {
+	logger := gmpctx.LoggerFromContext(ctx)
+
+	goModFile, err := gmpctx.GoModFileFromContextOrError(ctx)
+	if err != nil {
+		return err
+	}
+
+	var result error
+	for _, replace := range r.Replaces {
+		if err := goModFile.AddReplace(replace); err != nil {
+			result = multierror.Append(result, err)
 			continue
 		}
-		aggregate.FilesToCopy = append(aggregate.FilesToCopy, r.FilesToCopy...)
-		aggregate.FilesToDelete = append(aggregate.FilesToDelete, r.FilesToDelete...)
-		aggregate.Patches = append(aggregate.Patches, r.Patches...)
-		aggregate.Replaces = append(aggregate.Replaces, r.Replaces...)
 	}
 
-	return &aggregate
-}
+	for _, require := range r.Requires {
+		if err := goModFile.UpdatePackage(require.Path, require.Version); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		level.Info(logger).Log("msg", fmt.Sprintf("updated require '%s' to '%s' successfully", require.Path, require.Version))
+	}
 
-type taskRunner interface {
-	run(ctx context.Context) (*Result, error)
-}
+	for _, exclude := range r.Excludes {
+		if err := goModFile.AddExclude(exclude.Path, exclude.Version); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		level.Info(logger).Log("msg", fmt.Sprintf("added exclude '%s' '%s' successfully", exclude.Path, exclude.Version))
+	}
 
-type Task struct {
-	SyncDirectory             *TaskSyncDirectory             `yaml:"sync_directory"`
-	Diff                      *TaskDiff                      `yaml:"diff"`
-	Regexp                    *TaskRegexp                    `yaml:"regexp"`
-	PinUpstreamPackageVersion *TaskPinUpstreamPackageVersion `yaml:"pin_upstream_package_version"`
-	ImportUpstreamReplaces    *TaskImportUpstreamReplaces    `yaml:"import_upstream_replaces"`
+	return result
 }
 
-func (t *Task) Run(ctx context.Context) (*Result, error) {
-	var runners []taskRunner
+// ApplyCommands runs the generates, commands and checks of the result. It
+// is called after all results have been applied, so they see the changes of
+// every result.
+func (r *Result) ApplyCommands(ctx context.Context) error {
+	logger := gmpctx.LoggerFromContext(ctx)
 
-	if t.SyncDirectory != nil {
-		runners = append(runners, t.SyncDirectory)
+	var result error
+
+	for _, generate := range r.Generates {
+		if err := generate.Apply(ctx); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		level.Info(logger).Log("msg", fmt.Sprintf("generated '%s' successfully", generate.Dir))
+	}
+
+	for _, c := range r.Commands {
+		if err := c.Apply(ctx); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		level.Info(logger).Log("msg", fmt.Sprintf("ran command '%s' successfully", c.Name))
+	}
+
+	for _, c := range r.Checks {
+		if err := c.Apply(ctx); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		level.Info(logger).Log("msg", fmt.Sprintf("ran check '%s' successfully", c.Name))
+	}
+
+	return result
+}
+
+// AggregateResult combines the results into a single one. Identical patches,
+// copies and deletes are only kept once, so they are not applied twice.
+func AggregateResult(ctx context.Context, results ...*Result) *Result {
+	logger := gmpctx.LoggerFromContext(ctx)
+
+	var aggregate Result
+	seenPatches := make(map[[sha256.Size]byte]struct{})
+	seenCopies := make(map[Copy]struct{})
+	seenDeletes := make(map[Delete]struct{})
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		for _, c := range r.FilesToCopy {
+			if _, ok := seenCopies[c]; ok {
+				level.Debug(logger).Log("msg", "dropped duplicate copy", "source", c.Source, "destination", c.Destination)
+				continue
+			}
+			seenCopies[c] = struct{}{}
+			aggregate.FilesToCopy = append(aggregate.FilesToCopy, c)
+		}
+		for _, d := range r.FilesToDelete {
+			if _, ok := seenDeletes[d]; ok {
+				level.Debug(logger).Log("msg", "dropped duplicate delete", "path", string(d))
+				continue
+			}
+			seenDeletes[d] = struct{}{}
+			aggregate.FilesToDelete = append(aggregate.FilesToDelete, d)
+		}
+		for _, p := range r.Patches {
+			h := sha256.Sum256(p.Body)
+			if _, ok := seenPatches[h]; ok {
+				level.Debug(logger).Log("msg", "dropped duplicate patch", "sha256", fmt.Sprintf("%x", h))
+				continue
+			}
+			seenPatches[h] = struct{}{}
+			aggregate.Patches = append(aggregate.Patches, p)
+		}
+		aggregate.FilesToRename = append(aggregate.FilesToRename, r.FilesToRename...)
+		aggregate.Replaces = append(aggregate.Replaces, r.Replaces...)
+		aggregate.Requires = append(aggregate.Requires, r.Requires...)
+		aggregate.Excludes = append(aggregate.Excludes, r.Excludes...)
+		aggregate.Generates = append(aggregate.Generates, r.Generates...)
+		aggregate.Commands = append(aggregate.Commands, r.Commands...)
+		aggregate.Checks = append(aggregate.Checks, r.Checks...)
+	}
+
+	return &aggregate
+}
+
+// CheckConflicts returns an error listing the destinations, which are copied
+// from sources with different content or are both copied and deleted by the
+// results.
+func CheckConflicts(ctx context.Context, results ...*Result) error {
+	copies := make(map[string]string)
+	deletes := make(map[string]struct{})
+	conflicts := make(map[string]struct{})
+
+	hashes := make(map[string]string)
+	hash := func(path string) (string, error) {
+		if sum, ok := hashes[path]; ok {
+			return sum, nil
+		}
+		sum, err := hashPath(ctx, path, HashAlgoSHA256)
+		if err != nil {
+			return "", err
+		}
+		hashes[path] = sum
+		return sum, nil
+	}
+
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		for _, c := range r.FilesToCopy {
+			destination := filepath.Clean(c.Destination)
+			if source, ok := copies[destination]; ok && source != c.Source {
+				sourceHash, err := hash(source)
+				if err != nil {
+					return err
+				}
+				otherHash, err := hash(c.Source)
+				if err != nil {
+					return err
+				}
+				if sourceHash != otherHash {
+					conflicts[destination] = struct{}{}
+				}
+			}
+			copies[destination] = c.Source
+		}
+		for _, d := range r.FilesToDelete {
+			deletes[filepath.Clean(string(d))] = struct{}{}
+		}
+	}
+	for destination := range deletes {
+		if _, ok := copies[destination]; ok {
+			conflicts[destination] = struct{}{}
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(conflicts))
+	for path := range conflicts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return fmt.Errorf("conflicting changes to the same destination: %s", strings.Join(paths, ", "))
+}
+
+type taskRunner interface {
+	run(ctx context.Context) (*Result, error)
+}
+
+type Task struct {
+	SyncDirectory             *TaskSyncDirectory             `yaml:"sync_directory" json:"sync_directory"`
+	Diff                      *TaskDiff                      `yaml:"diff" json:"diff"`
+	Regexp                    *TaskRegexp                    `yaml:"regexp" json:"regexp"`
+	PinUpstreamPackageVersion *TaskPinUpstreamPackageVersion `yaml:"pin_upstream_package_version" json:"pin_upstream_package_version"`
+	ImportUpstreamReplaces    *TaskImportUpstreamReplaces    `yaml:"import_upstream_replaces" json:"import_upstream_replaces"`
+	ImportUpstreamExcludes    *TaskImportUpstreamExcludes    `yaml:"import_upstream_excludes" json:"import_upstream_excludes"`
+	Require                   *TaskRequire                   `yaml:"require" json:"require"`
+	GoGenerate                *TaskGoGenerate                `yaml:"go_generate" json:"go_generate"`
+	Command                   *TaskCommand                   `yaml:"command" json:"command"`
+	Template                  *TaskTemplate                  `yaml:"template" json:"template"`
+	GoModReplaceLocal         *TaskGoModReplaceLocal         `yaml:"go_mod_replace_local" json:"go_mod_replace_local"`
+	Rename                    *TaskRename                    `yaml:"rename" json:"rename"`
+	HTTPDownload              *TaskHTTPDownload              `yaml:"http_download" json:"http_download"`
+}
+
+// Name returns the config key of the task implementation.
+func (t *Task) Name() string {
+	switch {
+	case t.SyncDirectory != nil:
+		return "sync_directory"
+	case t.Diff != nil:
+		return "diff"
+	case t.Regexp != nil:
+		return "regexp"
+	case t.PinUpstreamPackageVersion != nil:
+		return "pin_upstream_package_version"
+	case t.ImportUpstreamReplaces != nil:
+		return "import_upstream_replaces"
+	case t.ImportUpstreamExcludes != nil:
+		return "import_upstream_excludes"
+	case t.Require != nil:
+		return "require"
+	case t.GoGenerate != nil:
+		return "go_generate"
+	case t.Command != nil:
+		return "command"
+	case t.Template != nil:
+		return "template"
+	case t.GoModReplaceLocal != nil:
+		return "go_mod_replace_local"
+	case t.Rename != nil:
+		return "rename"
+	case t.HTTPDownload != nil:
+		return "http_download"
+	default:
+		return ""
+	}
+}
+
+func (t *Task) Run(ctx context.Context) (*Result, error) {
+	var runners []taskRunner
+
+	if t.SyncDirectory != nil {
+		runners = append(runners, t.SyncDirectory)
 	}
 
 	if t.Diff != nil {
@@ -257,10 +1001,42 @@ func (t *Task) Run(ctx context.Context) (*Result, error) {
 		runners = append(runners, t.ImportUpstreamReplaces)
 	}
 
+	if t.ImportUpstreamExcludes != nil {
+		runners = append(runners, t.ImportUpstreamExcludes)
+	}
+
 	if t.Regexp != nil {
 		runners = append(runners, t.Regexp)
 	}
 
+	if t.Require != nil {
+		runners = append(runners, t.Require)
+	}
+
+	if t.GoGenerate != nil {
+		runners = append(runners, t.GoGenerate)
+	}
+
+	if t.Command != nil {
+		runners = append(runners, t.Command)
+	}
+
+	if t.Template != nil {
+		runners = append(runners, t.Template)
+	}
+
+	if t.GoModReplaceLocal != nil {
+		runners = append(runners, t.GoModReplaceLocal)
+	}
+
+	if t.Rename != nil {
+		runners = append(runners, t.Rename)
+	}
+
+	if t.HTTPDownload != nil {
+		runners = append(runners, t.HTTPDownload)
+	}
+
 	if len(runners) == 0 {
 		return nil, fmt.Errorf("No task implementation specified")
 	}
@@ -272,18 +1048,18 @@ func (t *Task) Run(ctx context.Context) (*Result, error) {
 }
 
 type Regexp struct {
-	Path   string `yaml:"path"`
-	Regexp string `yaml:"regexp"`
+	Path   string `yaml:"path" json:"path"`
+	Regexp string `yaml:"regexp" json:"regexp"`
 }
 
 type RegexpDestination struct {
-	Regexp `yaml:"inline"`
-	Value  string `yaml:"value"`
+	Regexp `yaml:"inline" json:"inline"`
+	Value  string `yaml:"value" json:"value"`
 }
 
 type TaskRegexp struct {
-	Source       Regexp   `yaml:"source"`
-	Destinations []Regexp `yaml:"destinations"`
+	Source       Regexp   `yaml:"source" json:"source"`
+	Destinations []Regexp `yaml:"destinations" json:"destinations"`
 }
 
 func (t *TaskRegexp) run(ctx context.Context) (*Result, error) {
@@ -294,7 +1070,10 @@ func (t *TaskRegexp) run(ctx context.Context) (*Result, error) {
 		return nil, err
 	}
 
-	after := gmpctx.GoModAfterFromContext(ctx)
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
 	sourcePath := filepath.Join(after.Dir, t.Source.Path)
 	sourceData, err := ioutil.ReadFile(sourcePath)
 	if err != nil {
@@ -316,9 +1095,12 @@ func (t *TaskRegexp) run(ctx context.Context) (*Result, error) {
 type TaskPinUpstreamPackageVersion string
 
 func (t *TaskPinUpstreamPackageVersion) run(ctx context.Context) (*Result, error) {
-	after := gmpctx.GoModAfterFromContext(ctx)
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	goModFile, err := gomod.NewGoModFromContext(gmpctx.RootPathIntoContext(ctx, after.Dir))
+	goModFile, err := gomod.NewGoModFromDir(ctx, after.Dir)
 	if err != nil {
 		return nil, err
 	}
@@ -350,9 +1132,12 @@ type TaskImportUpstreamReplaces struct {
 }
 
 func (t *TaskImportUpstreamReplaces) run(ctx context.Context) (*Result, error) {
-	after := gmpctx.GoModAfterFromContext(ctx)
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	goModFile, err := gomod.NewGoModFromContext(gmpctx.RootPathIntoContext(ctx, after.Dir))
+	goModFile, err := gomod.NewGoModFromDir(ctx, after.Dir)
 	if err != nil {
 		return nil, err
 	}
@@ -370,204 +1155,1182 @@ func (t *TaskImportUpstreamReplaces) run(ctx context.Context) (*Result, error) {
 	}, nil
 }
 
-type TaskGoModReplace struct {
-	Name string `yaml:"name"`
+// TaskImportUpstreamExcludes mirrors the exclude directives of the upstream
+// go.mod.
+type TaskImportUpstreamExcludes struct {
 }
 
-func (t *TaskGoModReplace) run(ctx context.Context) (*Result, error) {
-	return nil, gmperr.ErrNotImplemented{}
+func (t *TaskImportUpstreamExcludes) run(ctx context.Context) (*Result, error) {
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	goModFile, err := gomod.NewGoModFromDir(ctx, after.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Excludes: goModFile.GetExcludes(),
+	}, nil
 }
 
-type TaskDiff struct {
-	Source      string `yaml:"source"`
-	Destination string `yaml:"destination"`
+// TaskRequire updates the require of a dependency in go.mod. If no Version is
+// specified, the version required by the upstream module is used.
+type TaskRequire struct {
+	Name    string `yaml:"name" json:"name"`
+	Version string `yaml:"version" json:"version"`
 }
 
-func (t *TaskDiff) run(ctx context.Context) (*Result, error) {
+func (t *TaskRequire) run(ctx context.Context) (*Result, error) {
+	if t.Name == "" {
+		return nil, fmt.Errorf("require task needs a name")
+	}
 
-	before := gmpctx.GoModBeforeFromContext(ctx)
-	after := gmpctx.GoModAfterFromContext(ctx)
+	version := t.Version
+	if version == "" {
+		after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	cmd := command.New(ctx, "diff",
-		"-u",
-		filepath.Join(before.Dir, t.Source),
-		filepath.Join(after.Dir, t.Source),
-	)
+		goModFile, err := gomod.NewGoModFromDir(ctx, after.Dir)
+		if err != nil {
+			return nil, err
+		}
 
-	if err := cmd.Run(); err != nil {
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) && exitErr.ExitCode() != 1 {
+		version, err = goModFile.GetVersionForPackage(t.Name)
+		if err != nil {
 			return nil, err
 		}
 	}
 
-	var diff []byte
+	return &Result{
+		Requires: []module.Version{{
+			Path:    t.Name,
+			Version: version,
+		}},
+	}, nil
+}
 
-	scanner := bufio.NewScanner(&cmd.Stdout)
-	for scanner.Scan() {
-		b := scanner.Bytes()
-		var path string
+// TaskGoGenerate runs go generate in the destination tree, once the other
+// tasks have been applied. The generated changes are committed together with
+// the promotion.
+type TaskGoGenerate struct {
+	// Path is the directory relative to the root, in which go generate is
+	// run. Defaults to the root.
+	Path string `yaml:"path" json:"path"`
+	// Packages are the package patterns passed to go generate, defaults to
+	// ./...
+	Packages []string `yaml:"packages" json:"packages"`
+	// Env sets additional environment variables for the generator
+	Env map[string]string `yaml:"env" json:"env"`
+}
 
-		// if +++ or --- line rewrite the file paths
-		if bytes.HasPrefix(b, []byte("+++")) {
-			path = "new"
-		} else if bytes.HasPrefix(b, []byte("---")) {
-			path = "old"
-		} else {
-			diff = append(diff, b...)
-			diff = append(diff, byte('\n'))
-			continue
-		}
+func (t *TaskGoGenerate) run(ctx context.Context) (*Result, error) {
+	rootPath, err := gmpctx.RootPathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := t.Packages
+	if len(packages) == 0 {
+		packages = []string{"./..."}
+	}
 
-		path = filepath.Join(path, t.Destination)
+	return &Result{
+		Generates: []Generate{{
+			Dir:      filepath.Join(rootPath, t.Path),
+			Packages: packages,
+			Env:      t.Env,
+		}},
+	}, nil
+}
 
-		diff = append(diff, append(
-			b[:4],
-			path...,
-		)...)
+// TaskCommand runs a configured executable in the destination tree. It only
+// runs if allow_commands is set to true in the config.
+type TaskCommand struct {
+	Command string   `yaml:"command" json:"command"`
+	Args    []string `yaml:"args" json:"args"`
+	// Path is the directory relative to the root, in which the command is
+	// run. Defaults to the root.
+	Path string `yaml:"path" json:"path"`
+	// If MutatesFiles is set to true, the changes of the command are
+	// committed together with the promotion. Otherwise it is only run to
+	// validate the result, e.g. by running the tests. Either way it runs
+	// after the other tasks have been applied and never in a dry-run.
+	MutatesFiles bool `yaml:"mutates_files" json:"mutates_files"`
+}
 
-		// add everything after the path in the original line
-		offset := 3
-		pos := bytes.IndexRune(b[offset:], '\t')
-		if pos > 0 {
-			pos += offset
-			diff = append(diff, b[pos:]...)
-		}
+func (t *TaskCommand) run(ctx context.Context) (*Result, error) {
+	if !gmpctx.AllowCommandsFromContext(ctx) {
+		return nil, gmperr.ErrCommandsNotAllowed{Command: t.Command}
+	}
 
-		diff = append(diff, byte('\n'))
+	rootPath, err := gmpctx.RootPathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := scanner.Err(); err != nil {
+	c := Command{
+		Dir:  filepath.Join(rootPath, t.Path),
+		Name: t.Command,
+		Args: t.Args,
+	}
+
+	if t.MutatesFiles {
+		return &Result{Commands: []Command{c}}, nil
+	}
+	return &Result{Checks: []Command{c}}, nil
+}
+
+type TaskGoModReplace struct {
+	Name string `yaml:"name" json:"name"`
+}
+
+func (t *TaskGoModReplace) run(ctx context.Context) (*Result, error) {
+	return nil, gmperr.ErrNotImplemented{}
+}
+
+// TaskGoModReplaceLocal replaces a module with a directory on the local
+// filesystem.
+type TaskGoModReplaceLocal struct {
+	// Old is the module path to replace
+	Old string `yaml:"old" json:"old"`
+	// NewPath is the directory replacing the module, relative to the module
+	// directory. It needs to start with ./ or ../, unless it is absolute.
+	NewPath string `yaml:"new_path" json:"new_path"`
+}
+
+func (t *TaskGoModReplaceLocal) run(ctx context.Context) (*Result, error) {
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Old == "" {
+		return nil, fmt.Errorf("old module path of local replace is empty")
+	}
+
+	newPath := filepath.ToSlash(t.NewPath)
+	if !modfile.IsDirectoryPath(newPath) {
+		return nil, fmt.Errorf("local replace path '%s' needs to start with ./ or ../, or be absolute", t.NewPath)
+	}
+
+	modulePath, err := gmpctx.ModulePathFromContextOrError(ctx)
+	if err != nil {
 		return nil, err
 	}
+	dir := t.NewPath
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(modulePath, dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("local replace path '%s' of '%s': %w", t.NewPath, t.Old, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("local replace path '%s' of '%s' is not a directory", t.NewPath, t.Old)
+	}
 
 	return &Result{
-		Patches: []Patch{
-			{
-				Body: diff,
+		Replaces: []api.GoModReplace{{
+			Replace: modfile.Replace{
+				Old: module.Version{
+					Path: t.Old,
+				},
+				New: module.Version{
+					Path: newPath,
+				},
 			},
-		},
+			Priority: api.GoModReplacePriorityLocal,
+			Comment:  fmt.Sprintf("local replace from %s", after.Path),
+		}},
 	}, nil
 }
 
-type TaskSyncDirectory struct {
-	Source      string `yaml:"source"`
-	Destination string `yaml:"destination"`
-	Glob        string `yaml:"glob"`
-	Recursive   *bool  `yaml:"recursive"`
+// TaskRename moves a file in the destination tree, e.g. when upstream has
+// relocated it. Once the file has been moved, the task does nothing.
+type TaskRename struct {
+	// From is the current path relative to the root
+	From string `yaml:"from" json:"from"`
+	// To is the new path relative to the root
+	To string `yaml:"to" json:"to"`
 }
 
-func hash(path string) (string, error) {
-	f, err := os.Open(path)
+func (t *TaskRename) run(ctx context.Context) (*Result, error) {
+	rootPath, err := gmpctx.RootPathFromContextOrError(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer f.Close()
+	fromPath := filepath.Join(rootPath, t.From)
+	toPath := filepath.Join(rootPath, t.To)
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+	fromExists, err := fileExists(fromPath)
+	if err != nil {
+		return nil, err
+	}
+	toExists, err := fileExists(toPath)
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
+	switch {
+	case !fromExists && toExists:
+		// renamed already
+		return &Result{}, nil
+	case !fromExists:
+		return nil, fmt.Errorf("file '%s' to rename doesn't exist", t.From)
+	case toExists:
+		return nil, fmt.Errorf("can't rename '%s', as '%s' exists already", t.From, t.To)
+	}
 
-func (t *TaskSyncDirectory) walkDirectory(dirPath string, m map[string]string) error {
-	if err := filepath.Walk(dirPath, func(path string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	// the closest existing parent of the destination needs to be a directory
+	for dir := filepath.Dir(toPath); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
-		if f.IsDir() {
-			return nil
+		if !info.IsDir() {
+			return nil, fmt.Errorf("can't rename '%s' to '%s', as '%s' is not a directory", t.From, t.To, dir)
 		}
+		break
+	}
 
-		baseName := filepath.Base(path)
+	return &Result{
+		FilesToRename: []Rename{{
+			From: t.From,
+			To:   t.To,
+		}},
+	}, nil
+}
 
-		relPath, err := filepath.Rel(dirPath, path)
-		if err != nil {
-			return err
-		}
+// TaskDiff patches the destination with the upstream changes of source, which
+// can either be a file or a directory.
+type TaskDiff struct {
+	Source      string `yaml:"source" json:"source"`
+	Destination string `yaml:"destination" json:"destination"`
+	// Fuzz sets the maximum fuzz factor when applying the patch
+	Fuzz *int `yaml:"fuzz" json:"fuzz"`
+	// If ThreeWay is set to true, git apply --3way is used when patch would
+	// reject hunks.
+	ThreeWay bool `yaml:"three_way" json:"three_way"`
+	// PatchBackend selects the tool applying the diff, either patch (the
+	// default) or git. It defaults to git for the git format.
+	PatchBackend PatchBackend `yaml:"patch_backend" json:"patch_backend"`
+	// Format selects the diff format, either unified (the default) or git.
+	// The git format supports binary files and file modes.
+	Format DiffFormat `yaml:"format" json:"format"`
+	// ContextLines sets the lines of context around changes, it defaults to
+	// 3. More context makes patches reject when the destination has drifted
+	// from upstream close to a change, less context makes them more likely
+	// to apply at the wrong position.
+	ContextLines *int `yaml:"context_lines" json:"context_lines"`
+	// NormalizeLineEndings ignores differences between CRLF and LF line
+	// endings, so they don't show up as changes to every line.
+	NormalizeLineEndings bool `yaml:"normalize_line_endings" json:"normalize_line_endings"`
+}
 
-		if t.Recursive != nil && !*t.Recursive {
-			if baseName != relPath {
-				return nil
-			}
-		}
+// defaultContextLines is the number of context lines of diff -u
+const defaultContextLines = 3
 
-		if t.Glob != "" {
-			if match, err := filepath.Match(t.Glob, baseName); err != nil {
-				return err
-			} else if !match {
-				return nil
-			}
-		}
+// diffOptions control how diffs are created
+type diffOptions struct {
+	contextLines         int
+	normalizeLineEndings bool
+}
 
-		m[relPath] = ""
-		return nil
-	}); err != nil {
-		return err
+func (t *TaskDiff) diffOptions() diffOptions {
+	return diffOptions{
+		contextLines:         t.contextLines(),
+		normalizeLineEndings: t.NormalizeLineEndings,
 	}
+}
 
-	return nil
+func (t *TaskDiff) contextLines() int {
+	if t.ContextLines == nil {
+		return defaultContextLines
+	}
+	return *t.ContextLines
 }
 
-func (t *TaskSyncDirectory) run(ctx context.Context) (*Result, error) {
-	logger := gmpctx.LoggerFromContext(ctx)
-	level.Info(logger).Log("msg", "sync task", "source", t.Source, "destination", t.Destination)
+// DiffFormat is the format of the diffs created by TaskDiff
+type DiffFormat string
 
-	after := gmpctx.GoModAfterFromContext(ctx)
+const (
+	DiffFormatDefault = DiffFormat("")
+	DiffFormatUnified = DiffFormat("unified")
+	DiffFormatGit     = DiffFormat("git")
+)
 
-	sourcePath := filepath.Join(after.Dir, t.Source)
-	destinationPath := filepath.Join(gmpctx.RootPathFromContext(ctx), t.Destination)
+func (t *TaskDiff) patchBackend() PatchBackend {
+	if t.PatchBackend == PatchBackendDefault && t.Format == DiffFormatGit {
+		return PatchBackendGit
+	}
+	return t.PatchBackend
+}
 
-	sourceFiles := make(map[string]string)
-	destinationFiles := make(map[string]string)
+func (t *TaskDiff) run(ctx context.Context) (*Result, error) {
+	if t.contextLines() < 0 {
+		return nil, fmt.Errorf("context_lines must not be negative")
+	}
 
-	if err := t.walkDirectory(sourcePath, sourceFiles); err != nil {
+	before, err := gmpctx.GoModBeforeFromContextOrError(ctx)
+	if err != nil {
 		return nil, err
 	}
-	if err := t.walkDirectory(destinationPath, destinationFiles); err != nil {
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	var result Result
+	beforePath := filepath.Join(before.Dir, t.Source)
+	afterPath := filepath.Join(after.Dir, t.Source)
 
-	for filePath := range sourceFiles {
-		if _, ok := destinationFiles[filePath]; ok {
-			// exists in dest
-			var err error
-			sourceFiles[filePath], err = hash(filepath.Join(sourcePath, filePath))
+	isDir, err := anyIsDir(beforePath, afterPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// binary files can't be patched in the unified format, they are copied
+	// instead
+	var binaries []string
+	var diff []byte
+	switch {
+	case t.Format == DiffFormatGit:
+		diff, err = diffGit(ctx, beforePath, afterPath, t.Destination, t.diffOptions())
+	case t.Format != DiffFormatDefault && t.Format != DiffFormatUnified:
+		return nil, fmt.Errorf("unknown diff format '%s'", t.Format)
+	case isDir:
+		diff, binaries, err = diffDirectory(ctx, beforePath, afterPath, t.Destination, t.diffOptions())
+	default:
+		var binary bool
+		binary, err = anyIsBinary(beforePath, afterPath)
+		if err == nil && binary {
+			binaries = []string{"."}
+		} else if err == nil {
+			diff, err = diffFile(ctx, beforePath, afterPath, t.Destination, t.diffOptions())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result Result
+	for _, relPath := range binaries {
+		if err := copyBinary(&result,
+			filepath.Join(beforePath, relPath),
+			filepath.Join(afterPath, relPath),
+			filepath.Join(t.Destination, relPath),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(diff) > 0 {
+		result.Patches = []Patch{
+			{
+				Body:      diff,
+				Fuzz:      t.Fuzz,
+				ThreeWay:  t.ThreeWay,
+				Backend:   t.patchBackend(),
+				NoContext: t.contextLines() == 0,
+			},
+		}
+	}
+
+	return &result, nil
+}
+
+// copyBinary adds a copy of the changed binary file to the result, or deletes
+// it if it has been removed upstream.
+func copyBinary(result *Result, beforePath, afterPath, destination string) error {
+	afterExists, err := fileExists(afterPath)
+	if err != nil {
+		return err
+	}
+	if !afterExists {
+		result.FilesToDelete = append(result.FilesToDelete, Delete(destination))
+		return nil
+	}
+
+	if beforeExists, err := fileExists(beforePath); err != nil {
+		return err
+	} else if beforeExists {
+		unchanged, err := sameBytes(beforePath, afterPath)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			return nil
+		}
+	}
+
+	result.FilesToCopy = append(result.FilesToCopy, Copy{
+		Source:      afterPath,
+		Destination: destination,
+	})
+	return nil
+}
+
+// sameBytes returns true, if both files have the same content.
+func sameBytes(a, b string) (bool, error) {
+	aData, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	bData, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aData, bData), nil
+}
+
+// anyIsBinary returns true, if one of the existing files has binary content.
+func anyIsBinary(paths ...string) (bool, error) {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		data := make([]byte, 8000)
+		n, err := io.ReadFull(f, data)
+		f.Close()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		if isBinary(data[:n]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// anyIsDir returns true if one of the existing paths is a directory
+func anyIsDir(paths ...string) (bool, error) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if info.IsDir() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// diffDirectory creates a unified diff of all text files within two
+// directories, with the paths in the headers rewritten relative to
+// destination. The relative paths of binary files are returned separately.
+func diffDirectory(ctx context.Context, beforeDir, afterDir, destination string, opts diffOptions) ([]byte, []string, error) {
+	files := make(map[string]struct{})
+	for _, dir := range []string{beforeDir, afterDir} {
+		if exists, err := fileExists(dir); err != nil {
+			return nil, nil, err
+		} else if !exists {
+			continue
+		}
+
+		if err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if f.IsDir() {
+				return nil
+			}
+			relPath, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files[relPath] = struct{}{}
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	relPaths := make([]string, 0, len(files))
+	for relPath := range files {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	var diff []byte
+	var binaries []string
+	for _, relPath := range relPaths {
+		binary, err := anyIsBinary(filepath.Join(beforeDir, relPath), filepath.Join(afterDir, relPath))
+		if err != nil {
+			return nil, nil, err
+		}
+		if binary {
+			binaries = append(binaries, relPath)
+			continue
+		}
+
+		fileDiff, err := diffFile(ctx,
+			filepath.Join(beforeDir, relPath),
+			filepath.Join(afterDir, relPath),
+			filepath.Join(destination, relPath),
+			opts,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		diff = append(diff, fileDiff...)
+	}
+
+	return diff, binaries, nil
+}
+
+// diffGit creates a diff in the git format between two files or directories,
+// with the paths in the headers set to destination. The diff is created by
+// git diff --no-index on copies of both sides, placed at destination below the
+// directories a and b, so it applies with -p1.
+func diffGit(ctx context.Context, beforePath, afterPath, destination string, opts diffOptions) ([]byte, error) {
+	tmpDir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for side, path := range map[string]string{"a": beforePath, "b": afterPath} {
+		sideDir := filepath.Join(tmpDir, side)
+		if err := os.MkdirAll(sideDir, 0755); err != nil {
+			return nil, err
+		}
+		if exists, err := fileExists(path); err != nil {
+			return nil, err
+		} else if !exists {
+			continue
+		}
+		if err := copyTree(path, filepath.Join(sideDir, destination), opts.normalizeLineEndings); err != nil {
+			return nil, err
+		}
+	}
+
+	args := []string{"diff", "--no-index", "--no-prefix", "--binary", fmt.Sprintf("-U%d", opts.contextLines)}
+	cmd := command.New(ctx, "git", append(args, "a", "b")...).WithDir(tmpDir)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() != 1 {
+			return nil, fmt.Errorf("error running git diff: %w stderr=[%s]", err, cmd.Stderr.String())
+		}
+	}
+
+	return cmd.Stdout.Bytes(), nil
+}
+
+// copyTree copies a file or a directory recursively, keeping symlinks and the
+// executable bit. If normalizeLineEndings is set, the line endings of text
+// files are converted to LF.
+func copyTree(source, destination string, normalizeLineEndings bool) error {
+	return filepath.Walk(source, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, relPath)
+
+		switch {
+		case f.IsDir():
+			return os.MkdirAll(target, 0755)
+		case f.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !f.Mode().IsRegular():
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if normalizeLineEndings && !isBinary(data) {
+			data = convertLineEndings(data, "\n")
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, f.Mode().Perm()|0600)
+	})
+}
+
+// diffFile creates a unified diff between two files, with the paths in the
+// headers rewritten to destination. Files missing on one side are diffed
+// against /dev/null, so the patch creates or deletes the file.
+func diffFile(ctx context.Context, beforePath, afterPath, destination string, opts diffOptions) ([]byte, error) {
+	oldPath := filepath.Join("old", destination)
+	newPath := filepath.Join("new", destination)
+
+	beforeExists, err := fileExists(beforePath)
+	if err != nil {
+		return nil, err
+	}
+	afterExists, err := fileExists(afterPath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !beforeExists && !afterExists:
+		return nil, fmt.Errorf("neither '%s' nor '%s' exist", beforePath, afterPath)
+	case !beforeExists:
+		beforePath = os.DevNull
+		oldPath = "/dev/null"
+	case !afterExists:
+		afterPath = os.DevNull
+		newPath = "/dev/null"
+	}
+
+	args := []string{fmt.Sprintf("-U%d", opts.contextLines)}
+	if opts.normalizeLineEndings {
+		args = append(args, "--strip-trailing-cr")
+	}
+	cmd := command.New(ctx, "diff", append(args, beforePath, afterPath)...)
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() != 1 {
+			return nil, err
+		}
+	}
+
+	var diff []byte
+
+	// only the header before the first hunk is rewritten, as removed lines
+	// starting with "-- " look like a header line otherwise
+	inHeader := true
+	scanner := bufio.NewScanner(&cmd.Stdout)
+	for scanner.Scan() {
+		b := scanner.Bytes()
+
+		switch {
+		case inHeader && bytes.HasPrefix(b, []byte("+++ ")):
+			diff = append(diff, diffHeader("+++", b, afterPath, newPath)...)
+		case inHeader && bytes.HasPrefix(b, []byte("--- ")):
+			diff = append(diff, diffHeader("---", b, beforePath, oldPath)...)
+		default:
+			if bytes.HasPrefix(b, []byte("@@")) {
+				inHeader = false
+			}
+			diff = append(diff, b...)
+		}
+		diff = append(diff, byte('\n'))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return diff, nil
+}
+
+// diffHeader rewrites the path of a ---/+++ header line from originalPath to
+// path, keeping the timestamp following it.
+func diffHeader(marker string, line []byte, originalPath, path string) []byte {
+	rest := strings.TrimPrefix(string(line), marker+" ")
+
+	// diff separates the timestamp with a tab, the original path is matched
+	// first, as it might contain tabs itself. diff quotes paths containing
+	// special characters.
+	var suffix string
+	if pos := strings.LastIndexByte(rest, '\t'); pos >= 0 {
+		suffix = rest[pos:]
+	}
+	for _, name := range []string{originalPath, strconv.Quote(originalPath)} {
+		if strings.HasPrefix(rest, name) {
+			suffix = rest[len(name):]
+			break
+		}
+	}
+
+	// quote the path, if patch couldn't parse it otherwise
+	name := path
+	if strings.ContainsAny(name, "\t\n\"\\") {
+		name = strconv.Quote(name)
+	}
+
+	return []byte(marker + " " + name + suffix)
+}
+
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type TaskSyncDirectory struct {
+	Source      string `yaml:"source" json:"source"`
+	Destination string `yaml:"destination" json:"destination"`
+	// Glob is a single pattern alias for Globs
+	Glob string `yaml:"glob" json:"glob"`
+	// Globs restricts the synced files to the ones matching any of the
+	// patterns, if empty all files are synced. Patterns containing a slash
+	// are matched against the relative path and support "**".
+	Globs []string `yaml:"globs" json:"globs"`
+	// MaxFileSize aborts copying files larger than the given bytes, if set
+	MaxFileSize int64 `yaml:"max_file_size" json:"max_file_size"`
+	// Exclude lists patterns of relative paths which are neither copied nor
+	// deleted, "**" matches any number of directories.
+	Exclude []string `yaml:"exclude" json:"exclude"`
+	// DeleteExtraneous removes destination files missing in the source, it
+	// defaults to true
+	DeleteExtraneous *bool `yaml:"delete_extraneous" json:"delete_extraneous"`
+	// Recursive enables syncing of sub directories, it defaults to false
+	Recursive *bool `yaml:"recursive" json:"recursive"`
+	// FollowSymlinks syncs the content of symlinked files and, if Recursive
+	// is set, of symlinked directories. By default symlinks are recreated in
+	// the destination.
+	FollowSymlinks bool `yaml:"follow_symlinks" json:"follow_symlinks"`
+	// HashAlgo selects the hash used to detect changed files, it defaults to
+	// sha256. xxhash is considerably faster for large files.
+	HashAlgo HashAlgo `yaml:"hash_algo" json:"hash_algo"`
+	// PreviewDiff logs a unified diff of every file that is copied and adds
+	// it to the report.
+	PreviewDiff bool `yaml:"preview_diff" json:"preview_diff"`
+	// NormalizeLineEndings ignores differences between CRLF and LF line
+	// endings of text files, when comparing source and destination.
+	NormalizeLineEndings bool `yaml:"normalize_line_endings" json:"normalize_line_endings"`
+	// PreserveLineEndings converts the line endings of text files copied over
+	// an existing destination to the ones used by the destination.
+	PreserveLineEndings bool `yaml:"preserve_line_endings" json:"preserve_line_endings"`
+	// ExpectedSHA256 maps paths relative to the source to the hex encoded
+	// sha256 digest of their content. The task fails if a listed file is
+	// missing in the source or its content doesn't match.
+	ExpectedSHA256 map[string]string `yaml:"expected_sha256" json:"expected_sha256"`
+}
+
+// HashAlgo is a hash function used to compare file contents
+type HashAlgo string
+
+const (
+	HashAlgoDefault = HashAlgo("")
+	HashAlgoSHA256  = HashAlgo("sha256")
+	HashAlgoXXHash  = HashAlgo("xxhash")
+)
+
+// recursive resolves the Recursive setting, when it is not set only files
+// directly within the directory are synced.
+func (t *TaskSyncDirectory) recursive() bool {
+	if t.Recursive == nil {
+		return false
+	}
+	return *t.Recursive
+}
+
+// changed returns true, if the content of the source differs from the
+// destination.
+func (t *TaskSyncDirectory) changed(ctx context.Context, sourcePath, destinationPath string) (bool, error) {
+	// files of different size differ, without having to hash them
+	stat := os.Stat
+	if !t.FollowSymlinks {
+		stat = os.Lstat
+	}
+	sourceInfo, err := stat(sourcePath)
+	if err != nil {
+		return false, err
+	}
+	destinationInfo, err := stat(destinationPath)
+	if err != nil {
+		return false, err
+	}
+	if !t.NormalizeLineEndings && sourceInfo.Mode().IsRegular() && destinationInfo.Mode().IsRegular() && sourceInfo.Size() != destinationInfo.Size() {
+		return true, nil
+	}
+
+	sourceHash, err := t.hash(ctx, sourcePath)
+	if err != nil {
+		return false, err
+	}
+	destinationHash, err := t.hash(ctx, destinationPath)
+	if err != nil {
+		return false, err
+	}
+	return sourceHash != destinationHash, nil
+}
+
+// hash returns the hash of the file content. Unless symlinks are followed, the
+// hash of a symlink is based on its target.
+func (t *TaskSyncDirectory) hash(ctx context.Context, path string) (string, error) {
+	if !t.FollowSymlinks {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("symlink:%s", target), nil
+		}
+	}
+	if t.NormalizeLineEndings {
+		return hashPathNormalized(ctx, path, t.HashAlgo)
+	}
+	return hashPath(ctx, path, t.HashAlgo)
+}
+
+// hashPathNormalized hashes the content of text files with all line endings
+// converted to LF.
+func hashPathNormalized(ctx context.Context, path string, algo HashAlgo) (string, error) {
+	var data []byte
+	if err := retryFS(ctx, func() error {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	if !isBinary(data) {
+		data = convertLineEndings(data, "\n")
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	if _, err := h.Write(data); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func hashPath(ctx context.Context, path string, algo HashAlgo) (string, error) {
+	var sum string
+	err := retryFS(ctx, func() error {
+		var err error
+		sum, err = hashFile(path, algo)
+		return err
+	})
+	return sum, err
+}
+
+// verifySHA256 returns an error, if the sha256 digest of the file content
+// doesn't match the expected hex encoded digest.
+func verifySHA256(ctx context.Context, path, expected string) error {
+	actual, err := hashPath(ctx, path, HashAlgoSHA256)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, expected) {
+		return gmperr.ErrChecksumMismatch{Path: path, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+func newHash(algo HashAlgo) (hash.Hash, error) {
+	switch algo {
+	case HashAlgoDefault, HashAlgoSHA256:
+		return sha256.New(), nil
+	case HashAlgoXXHash:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash_algo '%s'", algo)
+	}
+}
+
+func hashFile(path string, algo HashAlgo) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// matchPath matches a pattern against a slash separated relative path. In
+// addition to the syntax of path.Match, a "**" path element matches zero or
+// more directories, e.g. pkg/**/*.go.
+func matchPath(pattern, relPath string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(filepath.ToSlash(relPath), "/"))
+}
+
+func matchSegments(pattern, parts []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try to match the rest of the pattern at every position
+			for pos := 0; pos <= len(parts); pos++ {
+				if match, err := matchSegments(pattern[1:], parts[pos:]); err != nil || match {
+					return match, err
+				}
 			}
+			return false, nil
+		}
+
+		if len(parts) == 0 {
+			return false, nil
+		}
+		if match, err := path.Match(pattern[0], parts[0]); err != nil || !match {
+			return false, err
+		}
+
+		pattern = pattern[1:]
+		parts = parts[1:]
+	}
+
+	return len(parts) == 0, nil
+}
+
+func (t *TaskSyncDirectory) excluded(relPath string) (bool, error) {
+	for _, pattern := range t.Exclude {
+		if match, err := matchPath(pattern, relPath); err != nil {
+			return false, err
+		} else if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *TaskSyncDirectory) globs() []string {
+	if t.Glob == "" {
+		return t.Globs
+	}
+	return append([]string{t.Glob}, t.Globs...)
+}
+
+// included checks if the file matches any of the globs. Globs containing a
+// slash are matched against the relative path, others against the base name.
+func (t *TaskSyncDirectory) included(relPath string) (bool, error) {
+	globs := t.globs()
+	if len(globs) == 0 {
+		return true, nil
+	}
+
+	for _, glob := range globs {
+		var match bool
+		var err error
+		if strings.Contains(glob, "/") {
+			match, err = matchPath(glob, relPath)
 		} else {
-			result.FilesToCopy = append(result.FilesToCopy, Copy{
-				Source:      filepath.Join(sourcePath, filePath),
-				Destination: filepath.Join(t.Destination, filePath),
-			})
+			match, err = filepath.Match(glob, filepath.Base(relPath))
+		}
+		if err != nil {
+			return false, err
+		} else if match {
+			return true, nil
 		}
 	}
+	return false, nil
+}
 
-	for filePath := range destinationFiles {
-		if hashSource, ok := sourceFiles[filePath]; ok {
+// deleteExtraneous resolves the DeleteExtraneous setting, when it is not set
+// destination files missing in the source are deleted.
+func (t *TaskSyncDirectory) deleteExtraneous() bool {
+	if t.DeleteExtraneous == nil {
+		return true
+	}
+	return *t.DeleteExtraneous
+}
+
+func (t *TaskSyncDirectory) walkDirectory(dirPath string, m map[string]string) error {
+	return t.walk(dirPath, "", m)
+}
+
+// walk adds the files below dirPath to m, their paths are prefixed with
+// prefix. If FollowSymlinks is set, symlinked directories are walked as
+// well, unless they point to one of their parents.
+func (t *TaskSyncDirectory) walk(dirPath, prefix string, m map[string]string) error {
+	if err := filepath.Walk(dirPath, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			if path != dirPath && !t.recursive() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relPath, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.Join(prefix, relPath)
+
+		if !t.recursive() && filepath.Base(relPath) != relPath {
+			return nil
+		}
+
+		if t.FollowSymlinks && f.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if target.IsDir() {
+				if !t.recursive() {
+					return nil
+				}
+				if cycle, err := symlinkCycle(path); err != nil {
+					return err
+				} else if cycle {
+					return nil
+				}
+				// filepath.Walk doesn't descend into a symlink passed as
+				// root, so walk its target instead
+				resolved, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return err
+				}
+				return t.walk(resolved, relPath, m)
+			}
+		}
+
+		if excluded, err := t.excluded(relPath); err != nil {
+			return err
+		} else if excluded {
+			return nil
+		}
+
+		if included, err := t.included(relPath); err != nil {
+			return err
+		} else if !included {
+			return nil
+		}
+
+		m[relPath] = ""
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// symlinkCycle returns true, if the symlinked directory at path points to
+// one of its parents.
+func symlinkCycle(path string) (bool, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	return parent == target || strings.HasPrefix(parent, target+string(filepath.Separator)), nil
+}
+
+func (t *TaskSyncDirectory) run(ctx context.Context) (*Result, error) {
+	logger := gmpctx.LoggerFromContext(ctx)
+	level.Info(logger).Log("msg", "sync task", "source", t.Source, "destination", t.Destination)
+
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sourcePath := filepath.Join(after.Dir, t.Source)
+	rootPath, err := gmpctx.RootPathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+	destinationPath := filepath.Join(rootPath, t.Destination)
+
+	sourceFiles := make(map[string]string)
+	destinationFiles := make(map[string]string)
+
+	if err := t.walkDirectory(sourcePath, sourceFiles); err != nil {
+		return nil, err
+	}
+	if err := t.walkDirectory(destinationPath, destinationFiles); err != nil {
+		return nil, err
+	}
+
+	expectedSHA256 := make(map[string]string, len(t.ExpectedSHA256))
+	for filePath, digest := range t.ExpectedSHA256 {
+		filePath = filepath.Clean(filepath.FromSlash(filePath))
+		if _, ok := sourceFiles[filePath]; !ok {
+			return nil, fmt.Errorf("expected_sha256 lists '%s', which is not synced from the source", filePath)
+		}
+		expectedSHA256[filePath] = digest
+	}
+
+	var result Result
+
+	for filePath := range sourceFiles {
+		if _, ok := destinationFiles[filePath]; ok {
 			// exists in dest
-			var err error
-			destinationFiles[filePath], err = hash(filepath.Join(destinationPath, filePath))
+			changed, err := t.changed(ctx, filepath.Join(sourcePath, filePath), filepath.Join(destinationPath, filePath))
 			if err != nil {
 				return nil, err
 			}
-
-			if destinationFiles[filePath] != hashSource {
-				result.FilesToCopy = append(result.FilesToCopy, Copy{
-					Source:      filepath.Join(sourcePath, filePath),
-					Destination: filepath.Join(t.Destination, filePath),
-				})
+			if !changed {
+				// unchanged files are not copied, so they are verified here
+				if digest, ok := expectedSHA256[filePath]; ok {
+					if err := verifySHA256(ctx, filepath.Join(sourcePath, filePath), digest); err != nil {
+						return nil, err
+					}
+				}
+				continue
 			}
-		} else {
+		}
+		c := Copy{
+			Source:         filepath.Join(sourcePath, filePath),
+			Destination:    filepath.Join(t.Destination, filePath),
+			MaxSize:        t.MaxFileSize,
+			FollowSymlinks: t.FollowSymlinks,
+			ExpectedSHA256: expectedSHA256[filePath],
+		}
+		if _, ok := destinationFiles[filePath]; ok && t.PreserveLineEndings {
+			c.LineEnding, err = lineEndingOf(filepath.Join(destinationPath, filePath))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if t.PreviewDiff {
+			diff, err := diffFile(ctx, filepath.Join(destinationPath, filePath), c.Source, c.Destination, diffOptions{
+				contextLines:         defaultContextLines,
+				normalizeLineEndings: t.NormalizeLineEndings,
+			})
+			if err != nil {
+				return nil, err
+			}
+			c.Diff = string(diff)
+			level.Info(logger).Log("msg", "sync diff preview", "destination", c.Destination, "diff", c.Diff)
+		}
+		result.FilesToCopy = append(result.FilesToCopy, c)
+	}
+
+	for filePath := range destinationFiles {
+		if _, ok := sourceFiles[filePath]; !ok && t.deleteExtraneous() {
 			result.FilesToDelete = append(result.FilesToDelete, Delete(filepath.Join(t.Destination, filePath)))
 		}
 	}
 
+	result.sort()
 	return &result, nil //cmd.Run()
 
 }
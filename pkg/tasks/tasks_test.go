@@ -0,0 +1,1038 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+	gmperr "github.com/grafana/go-mod-promote/pkg/errors"
+	"github.com/grafana/go-mod-promote/pkg/gomod"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// testContext returns a context with an upstream module and a root path,
+// which are populated with the given files. The root path gets a go.mod, if
+// none is given.
+func testContext(t *testing.T, upstream, root map[string]string) (ctx context.Context, upstreamPath, rootPath string) {
+	t.Helper()
+	upstreamPath = t.TempDir()
+	rootPath = t.TempDir()
+	for name, content := range upstream {
+		writeFile(t, filepath.Join(upstreamPath, name), content)
+	}
+	for name, content := range root {
+		writeFile(t, filepath.Join(rootPath, name), content)
+	}
+
+	if _, ok := root["go.mod"]; !ok {
+		writeFile(t, filepath.Join(rootPath, "go.mod"), "module example.com/app\n\ngo 1.15\n")
+	}
+	goMod, err := gomod.NewGoModFromPath(filepath.Join(rootPath, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx = gmpctx.RootPathIntoContext(context.Background(), rootPath)
+	ctx = gmpctx.GoModFileIntoContext(ctx, goMod)
+	ctx = gmpctx.GoModAfterIntoContext(ctx, &api.GoModDownloadResult{Path: "example.com/up", Version: "v1.1.0", Dir: upstreamPath})
+	return ctx, upstreamPath, rootPath
+}
+
+// changes lists the destinations of copies and the deletes of the result.
+func changes(r *Result) (copies, deletes []string) {
+	for _, c := range r.FilesToCopy {
+		copies = append(copies, filepath.ToSlash(c.Destination))
+	}
+	for _, d := range r.FilesToDelete {
+		deletes = append(deletes, filepath.ToSlash(string(d)))
+	}
+	sort.Strings(copies)
+	sort.Strings(deletes)
+	return copies, deletes
+}
+
+func expectChanges(t *testing.T, r *Result, wantCopies, wantDeletes []string) {
+	t.Helper()
+	copies, deletes := changes(r)
+	if strings.Join(copies, ",") != strings.Join(wantCopies, ",") {
+		t.Errorf("expected copies %v, got %v", wantCopies, copies)
+	}
+	if strings.Join(deletes, ",") != strings.Join(wantDeletes, ",") {
+		t.Errorf("expected deletes %v, got %v", wantDeletes, deletes)
+	}
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+func TestSyncDirectoryRecursive(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		recursive   *bool
+		wantCopies  []string
+		wantDeletes []string
+	}{
+		{
+			name:        "default",
+			wantCopies:  []string{"dst/a.txt"},
+			wantDeletes: []string{"dst/old.txt"},
+		},
+		{
+			name:        "non-recursive",
+			recursive:   boolPtr(false),
+			wantCopies:  []string{"dst/a.txt"},
+			wantDeletes: []string{"dst/old.txt"},
+		},
+		{
+			name:        "recursive",
+			recursive:   boolPtr(true),
+			wantCopies:  []string{"dst/a.txt", "dst/sub/b.txt"},
+			wantDeletes: []string{"dst/old.txt", "dst/sub/keep.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _, _ := testContext(t, map[string]string{
+				"src/a.txt":     "a",
+				"src/sub/b.txt": "b",
+			}, map[string]string{
+				"dst/old.txt":      "old",
+				"dst/sub/keep.txt": "keep",
+			})
+
+			result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", Recursive: tc.recursive}).run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectChanges(t, result, tc.wantCopies, tc.wantDeletes)
+		})
+	}
+}
+
+func TestCopyMaxSize(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		maxSize int64
+		wantErr bool
+	}{
+		{name: "no limit"},
+		{name: "below limit", maxSize: 100},
+		{name: "at limit", maxSize: 10},
+		{name: "above limit", maxSize: 9, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, upstreamPath, rootPath := testContext(t, map[string]string{"file": "0123456789"}, nil)
+
+			c := Copy{Source: filepath.Join(upstreamPath, "file"), Destination: "file", MaxSize: tc.maxSize}
+			err := c.Apply(ctx)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if _, err := os.Stat(filepath.Join(rootPath, "file")); !os.IsNotExist(err) {
+					t.Error("destination must not be written for a file exceeding the limit")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := readFile(t, filepath.Join(rootPath, "file")); got != "0123456789" {
+				t.Errorf("unexpected content %q", got)
+			}
+		})
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var logs bytes.Buffer
+	w := &progressWriter{Writer: ioutil.Discard, logger: log.NewLogfmtLogger(&logs)}
+
+	chunk := make([]byte, copyProgressInterval/2)
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := strings.Count(logs.String(), "copy in progress"); got != 2 {
+		t.Errorf("expected 2 progress logs after writing 2.5 intervals, got %d:\n%s", got, logs.String())
+	}
+	if w.written != int64(len(chunk)*5) {
+		t.Errorf("expected %d bytes written, got %d", len(chunk)*5, w.written)
+	}
+}
+
+func TestSyncDirectoryExclude(t *testing.T) {
+	ctx, _, _ := testContext(t, map[string]string{
+		"src/a.txt":       "a",
+		"src/debug.log":   "upstream log",
+		"src/gen/x/y.txt": "generated",
+		"src/sub/b.txt":   "b",
+	}, map[string]string{
+		"dst/local.log":   "local log",
+		"dst/gen/z.txt":   "local generated",
+		"dst/sub/old.txt": "old",
+	})
+
+	result, err := (&TaskSyncDirectory{
+		Source:      "src",
+		Destination: "dst",
+		Recursive:   boolPtr(true),
+		Exclude:     []string{"*.log", "gen/**"},
+	}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChanges(t, result, []string{"dst/a.txt", "dst/sub/b.txt"}, []string{"dst/sub/old.txt"})
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{pattern: "*.log", path: "debug.log", want: true},
+		{pattern: "*.log", path: "sub/debug.log"},
+		{pattern: "**/*.log", path: "sub/debug.log", want: true},
+		{pattern: "**/*.log", path: "debug.log", want: true},
+		{pattern: "gen/**", path: "gen/x/y.txt", want: true},
+		{pattern: "gen/**", path: "other/gen/y.txt"},
+		{pattern: "a/**/b.txt", path: "a/x/y/b.txt", want: true},
+		{pattern: "a/**/b.txt", path: "a/b.txt", want: true},
+	} {
+		t.Run(tc.pattern+" "+tc.path, func(t *testing.T) {
+			got, err := matchPath(tc.pattern, filepath.FromSlash(tc.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSyncDirectoryDeleteExtraneous(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		deleteExtraneous *bool
+		wantDeletes      []string
+	}{
+		{name: "default", wantDeletes: []string{"dst/local.txt"}},
+		{name: "enabled", deleteExtraneous: boolPtr(true), wantDeletes: []string{"dst/local.txt"}},
+		{name: "disabled", deleteExtraneous: boolPtr(false)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _, _ := testContext(t, map[string]string{
+				"src/a.txt": "a",
+			}, map[string]string{
+				"dst/a.txt":     "outdated",
+				"dst/local.txt": "local",
+			})
+
+			result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", DeleteExtraneous: tc.deleteExtraneous}).run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectChanges(t, result, []string{"dst/a.txt"}, tc.wantDeletes)
+		})
+	}
+}
+
+// diffContext returns a context with the upstream module before and after
+// the update and a root path, which are populated with the given files.
+func diffContext(t *testing.T, before, after, root map[string]string) (ctx context.Context, rootPath string) {
+	t.Helper()
+	ctx, _, rootPath = testContext(t, after, root)
+	beforePath := t.TempDir()
+	for name, content := range before {
+		writeFile(t, filepath.Join(beforePath, name), content)
+	}
+	ctx = gmpctx.GoModBeforeIntoContext(ctx, &api.GoModDownloadResult{Path: "example.com/up", Version: "v1.0.0", Dir: beforePath})
+	return ctx, rootPath
+}
+
+// runDiff runs the diff task and applies its result.
+func runDiff(t *testing.T, ctx context.Context, task *TaskDiff) *Result {
+	t.Helper()
+	result, err := task.run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Apply(ctx); err != nil {
+		t.Fatalf("error applying diff: %v", err)
+	}
+	return result
+}
+
+func TestDiffAddedAndRemovedFiles(t *testing.T) {
+	for _, format := range []DiffFormat{DiffFormatUnified, DiffFormatGit} {
+		t.Run(string(format), func(t *testing.T) {
+			ctx, rootPath := diffContext(t, map[string]string{
+				"lib/changed.txt": "one\n",
+				"lib/removed.txt": "removed\n",
+			}, map[string]string{
+				"lib/changed.txt":   "two\n",
+				"lib/added.txt":     "added\n",
+				"lib/sub/added.txt": "nested\n",
+			}, map[string]string{
+				"vendor/lib/changed.txt": "one\n",
+				"vendor/lib/removed.txt": "removed\n",
+				"vendor/lib/local.txt":   "local\n",
+			})
+
+			runDiff(t, ctx, &TaskDiff{Source: "lib", Destination: "vendor/lib", Format: format})
+
+			for name, want := range map[string]string{
+				"vendor/lib/changed.txt":   "two\n",
+				"vendor/lib/added.txt":     "added\n",
+				"vendor/lib/sub/added.txt": "nested\n",
+				"vendor/lib/local.txt":     "local\n",
+			} {
+				if got := readFile(t, filepath.Join(rootPath, name)); got != want {
+					t.Errorf("unexpected content of %s: %q", name, got)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(rootPath, "vendor/lib/removed.txt")); !os.IsNotExist(err) {
+				t.Errorf("expected removed.txt to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	ctx, upstreamPath, _ := testContext(t, map[string]string{
+		"a.txt":       "a",
+		"a-again.txt": "a",
+		"b.txt":       "b",
+	}, nil)
+	source := func(name string) string {
+		return filepath.Join(upstreamPath, name)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		results []*Result
+		wantErr string
+	}{
+		{
+			name: "distinct destinations",
+			results: []*Result{
+				{FilesToCopy: []Copy{{Source: source("a.txt"), Destination: "a.txt"}}},
+				{FilesToCopy: []Copy{{Source: source("b.txt"), Destination: "b.txt"}}, FilesToDelete: []Delete{"c.txt"}},
+			},
+		},
+		{
+			name: "copies with identical content",
+			results: []*Result{
+				{FilesToCopy: []Copy{{Source: source("a.txt"), Destination: "out.txt"}}},
+				{FilesToCopy: []Copy{{Source: source("a-again.txt"), Destination: "out.txt"}}},
+			},
+		},
+		{
+			name: "copies with different content",
+			results: []*Result{
+				{FilesToCopy: []Copy{{Source: source("a.txt"), Destination: "out.txt"}}},
+				{FilesToCopy: []Copy{{Source: source("b.txt"), Destination: "./out.txt"}}},
+			},
+			wantErr: "out.txt",
+		},
+		{
+			name: "copy and delete",
+			results: []*Result{
+				{FilesToCopy: []Copy{{Source: source("a.txt"), Destination: "a.txt"}}},
+				{FilesToDelete: []Delete{"a.txt"}},
+			},
+			wantErr: "a.txt",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckConflicts(ctx, tc.results...)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), ": "+tc.wantErr) {
+				t.Fatalf("expected a conflict of %s, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSyncDirectoryOrder(t *testing.T) {
+	upstream := make(map[string]string)
+	root := make(map[string]string)
+	for _, name := range []string{"c", "a", "e", "b", "d", "sub/z", "sub/y"} {
+		upstream["src/"+name+".txt"] = name
+		root["dst/old-"+name+".txt"] = name
+	}
+	ctx, _, _ := testContext(t, upstream, root)
+
+	for i := 0; i < 5; i++ {
+		result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", Recursive: boolPtr(true)}).run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var copies, deletes []string
+		for _, c := range result.FilesToCopy {
+			copies = append(copies, c.Destination)
+		}
+		for _, d := range result.FilesToDelete {
+			deletes = append(deletes, string(d))
+		}
+		if !sort.StringsAreSorted(copies) {
+			t.Errorf("copies are not ordered by destination: %v", copies)
+		}
+		if !sort.StringsAreSorted(deletes) {
+			t.Errorf("deletes are not ordered: %v", deletes)
+		}
+	}
+}
+
+func TestResultSort(t *testing.T) {
+	r := &Result{
+		FilesToCopy: []Copy{
+			{Source: "2", Destination: "b"},
+			{Source: "1", Destination: "a"},
+			{Source: "3", Destination: "b"},
+		},
+		FilesToDelete: []Delete{"z", "x", "y"},
+	}
+	r.sort()
+
+	var copies []string
+	for _, c := range r.FilesToCopy {
+		copies = append(copies, c.Destination+"="+c.Source)
+	}
+	if got := strings.Join(copies, ","); got != "a=1,b=2,b=3" {
+		t.Errorf("unexpected order of copies %s", got)
+	}
+	if got := fmt.Sprint(r.FilesToDelete); got != "[x y z]" {
+		t.Errorf("unexpected order of deletes %s", got)
+	}
+}
+
+func TestAggregateResultDuplicates(t *testing.T) {
+	ctx, upstreamPath, rootPath := testContext(t, map[string]string{"new.txt": "new\n"}, map[string]string{
+		"patched.txt": "one\n",
+		"old.txt":     "old\n",
+	})
+
+	patch := []byte("--- a/patched.txt\n+++ b/patched.txt\n@@ -1 +1 @@\n-one\n+two\n")
+	newFile := Copy{Source: filepath.Join(upstreamPath, "new.txt"), Destination: "new.txt"}
+	single := func() *Result {
+		return &Result{
+			Patches:       []Patch{{Body: append([]byte(nil), patch...)}},
+			FilesToCopy:   []Copy{newFile},
+			FilesToDelete: []Delete{"old.txt"},
+		}
+	}
+
+	aggregate := AggregateResult(ctx, single(), nil, single())
+	if len(aggregate.Patches) != 1 || len(aggregate.FilesToCopy) != 1 || len(aggregate.FilesToDelete) != 1 {
+		t.Fatalf("expected duplicates to be dropped, got %d patches, %d copies and %d deletes", len(aggregate.Patches), len(aggregate.FilesToCopy), len(aggregate.FilesToDelete))
+	}
+
+	// applying the same patch twice would reject its hunks
+	if err := aggregate.Apply(ctx); err != nil {
+		t.Fatalf("error applying aggregate: %v", err)
+	}
+	if got := readFile(t, filepath.Join(rootPath, "patched.txt")); got != "two\n" {
+		t.Errorf("unexpected content of patched file %q", got)
+	}
+}
+
+func TestSyncDirectoryIdenticalTree(t *testing.T) {
+	files := map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	}
+	upstream := make(map[string]string)
+	root := make(map[string]string)
+	for name, content := range files {
+		upstream["src/"+name] = content
+		root["dst/"+name] = content
+	}
+	ctx, _, _ := testContext(t, upstream, root)
+
+	result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", Recursive: boolPtr(true)}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsEmpty() {
+		t.Errorf("expected an empty result for an identical tree, got copies %v and deletes %v", result.FilesToCopy, result.FilesToDelete)
+	}
+}
+
+func TestCopySkipsIdenticalDestination(t *testing.T) {
+	ctx, upstreamPath, rootPath := testContext(t, map[string]string{"file": "content"}, map[string]string{"file": "content"})
+
+	destination := filepath.Join(rootPath, "file")
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(destination, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Copy{Source: filepath.Join(upstreamPath, "file"), Destination: "file"}).Apply(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(past) {
+		t.Errorf("identical destination has been rewritten, modification time changed to %s", info.ModTime())
+	}
+}
+
+func TestSyncDirectoryChangedBySize(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		destination string
+		wantErr     bool
+	}{
+		// the unknown hash algorithm fails every attempt to hash a file
+		{name: "size differs", destination: "longer content"},
+		{name: "size matches", destination: "CONTENT", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, upstreamPath, rootPath := testContext(t, map[string]string{"file": "content"}, map[string]string{"file": tc.destination})
+			task := &TaskSyncDirectory{HashAlgo: HashAlgo("unknown")}
+
+			changed, err := task.changed(context.Background(), filepath.Join(upstreamPath, "file"), filepath.Join(rootPath, "file"))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected files of the same size to be hashed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("files of different size must not be hashed: %v", err)
+			}
+			if !changed {
+				t.Error("expected files of different size to be changed")
+			}
+		})
+	}
+}
+
+func TestSyncDirectoryHashAlgos(t *testing.T) {
+	upstream := map[string]string{
+		"src/unchanged.txt":     "same",
+		"src/changed.txt":       "new",
+		"src/same-size.txt":     "abcd",
+		"src/added.txt":         "added",
+		"src/sub/unchanged.txt": "nested",
+		"src/sub/changed.txt":   "nested new",
+	}
+	root := map[string]string{
+		"dst/unchanged.txt":     "same",
+		"dst/changed.txt":       "old content",
+		"dst/same-size.txt":     "dcba",
+		"dst/removed.txt":       "removed",
+		"dst/sub/unchanged.txt": "nested",
+		"dst/sub/changed.txt":   "nested old",
+	}
+
+	changesOf := func(algo HashAlgo) (copies, deletes []string) {
+		ctx, _, _ := testContext(t, upstream, root)
+		result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", Recursive: boolPtr(true), HashAlgo: algo}).run(ctx)
+		if err != nil {
+			t.Fatalf("hash_algo %q: %v", algo, err)
+		}
+		return changes(result)
+	}
+
+	wantCopies, wantDeletes := changesOf(HashAlgoSHA256)
+	if got := strings.Join(wantCopies, ","); got != "dst/added.txt,dst/changed.txt,dst/same-size.txt,dst/sub/changed.txt" {
+		t.Fatalf("unexpected copies of sha256: %s", got)
+	}
+	for _, algo := range []HashAlgo{HashAlgoDefault, HashAlgoXXHash} {
+		copies, deletes := changesOf(algo)
+		if strings.Join(copies, ",") != strings.Join(wantCopies, ",") || strings.Join(deletes, ",") != strings.Join(wantDeletes, ",") {
+			t.Errorf("hash_algo %q: expected copies %v and deletes %v like sha256, got %v and %v", algo, wantCopies, wantDeletes, copies, deletes)
+		}
+	}
+}
+
+func TestDiffHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		line         string
+		originalPath string
+		path         string
+		want         string
+	}{
+		{
+			name:         "timestamp",
+			line:         "--- /tmp/before/a.txt\t2021-01-01 00:00:00.000000000 +0000",
+			originalPath: "/tmp/before/a.txt",
+			path:         "old/vendor/a.txt",
+			want:         "--- old/vendor/a.txt\t2021-01-01 00:00:00.000000000 +0000",
+		},
+		{
+			name:         "no timestamp",
+			line:         "+++ /tmp/after/a.txt",
+			originalPath: "/tmp/after/a.txt",
+			path:         "new/vendor/a.txt",
+			want:         "+++ new/vendor/a.txt",
+		},
+		{
+			name:         "spaces",
+			line:         "--- /tmp/before dir/my file.txt\t2021-01-01 00:00:00.000000000 +0000",
+			originalPath: "/tmp/before dir/my file.txt",
+			path:         "old/vendor dir/my file.txt",
+			want:         "--- old/vendor dir/my file.txt\t2021-01-01 00:00:00.000000000 +0000",
+		},
+		{
+			name:         "spaces without timestamp",
+			line:         "+++ /tmp/after dir/my file.txt",
+			originalPath: "/tmp/after dir/my file.txt",
+			path:         "new/vendor dir/my file.txt",
+			want:         "+++ new/vendor dir/my file.txt",
+		},
+		{
+			name:         "quoted tab",
+			line:         "+++ \"/tmp/after/a\\tb.txt\"\t2021-01-01 00:00:00.000000000 +0000",
+			originalPath: "/tmp/after/a\tb.txt",
+			path:         "new/vendor/a\tb.txt",
+			want:         "+++ \"new/vendor/a\\tb.txt\"\t2021-01-01 00:00:00.000000000 +0000",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			marker := tc.line[:3]
+			if got := string(diffHeader(marker, []byte(tc.line), tc.originalPath, tc.path)); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDiffPathsWithSpaces(t *testing.T) {
+	ctx, rootPath := diffContext(t, map[string]string{
+		"lib dir/my file.txt": "one\ntwo\n",
+	}, map[string]string{
+		"lib dir/my file.txt": "one\nthree\n",
+	}, map[string]string{
+		"vendor dir/my file.txt": "one\ntwo\n",
+	})
+
+	result := runDiff(t, ctx, &TaskDiff{Source: "lib dir", Destination: "vendor dir"})
+	if len(result.Patches) != 1 {
+		t.Fatalf("expected a single patch, got %d", len(result.Patches))
+	}
+	if !bytes.Contains(result.Patches[0].Body, []byte("+++ new/vendor dir/my file.txt\t")) {
+		t.Errorf("unexpected patch header:\n%s", result.Patches[0].Body)
+	}
+	if got := readFile(t, filepath.Join(rootPath, "vendor dir/my file.txt")); got != "one\nthree\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+}
+
+func TestSyncDirectoryNormalizeLineEndings(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		normalize  bool
+		wantCopies []string
+	}{
+		{name: "default", wantCopies: []string{"dst/a.txt"}},
+		{name: "normalized", normalize: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _, _ := testContext(t, map[string]string{
+				"src/a.txt": "one\r\ntwo\r\n",
+			}, map[string]string{
+				"dst/a.txt": "one\ntwo\n",
+			})
+
+			result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", NormalizeLineEndings: tc.normalize}).run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectChanges(t, result, tc.wantCopies, nil)
+		})
+	}
+}
+
+func TestSyncDirectoryPreserveLineEndings(t *testing.T) {
+	ctx, _, rootPath := testContext(t, map[string]string{
+		"src/a.txt": "one\r\nthree\r\n",
+		"src/b.txt": "new\r\n",
+	}, map[string]string{
+		"dst/a.txt": "one\ntwo\n",
+	})
+
+	result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", PreserveLineEndings: true}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Apply(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(rootPath, "dst/a.txt")); got != "one\nthree\n" {
+		t.Errorf("expected the line endings of the destination to be kept, got %q", got)
+	}
+	// new files keep the line endings of the source
+	if got := readFile(t, filepath.Join(rootPath, "dst/b.txt")); got != "new\r\n" {
+		t.Errorf("expected the line endings of the source for a new file, got %q", got)
+	}
+}
+
+func TestDiffNormalizeLineEndings(t *testing.T) {
+	for _, format := range []DiffFormat{DiffFormatUnified, DiffFormatGit} {
+		t.Run(string(format), func(t *testing.T) {
+			ctx, rootPath := diffContext(t, map[string]string{
+				"lib/changed.txt":   "one\ntwo\n",
+				"lib/converted.txt": "unchanged\n",
+			}, map[string]string{
+				"lib/changed.txt":   "one\r\nthree\r\n",
+				"lib/converted.txt": "unchanged\r\n",
+			}, map[string]string{
+				"vendor/changed.txt":   "one\ntwo\n",
+				"vendor/converted.txt": "unchanged\n",
+			})
+
+			result := runDiff(t, ctx, &TaskDiff{Source: "lib", Destination: "vendor", Format: format, NormalizeLineEndings: true})
+			for _, p := range result.Patches {
+				if bytes.Contains(p.Body, []byte("converted.txt")) {
+					t.Errorf("a change of line endings only must not be diffed:\n%s", p.Body)
+				}
+			}
+			if got := readFile(t, filepath.Join(rootPath, "vendor/changed.txt")); got != "one\nthree\n" {
+				t.Errorf("unexpected content %q", got)
+			}
+		})
+	}
+}
+
+func TestConvertLineEndings(t *testing.T) {
+	for _, tc := range []struct {
+		in, ending, want string
+	}{
+		{in: "a\r\nb\nc", ending: "\n", want: "a\nb\nc"},
+		{in: "a\r\nb\nc", ending: "\r\n", want: "a\r\nb\r\nc"},
+		{in: "a\r\n\r\n", ending: "\r\n", want: "a\r\n\r\n"},
+	} {
+		if got := string(convertLineEndings([]byte(tc.in), tc.ending)); got != tc.want {
+			t.Errorf("converting %q to %q: expected %q, got %q", tc.in, tc.ending, tc.want, got)
+		}
+	}
+}
+
+func TestDiffBinaryFiles(t *testing.T) {
+	ctx, rootPath := diffContext(t, map[string]string{
+		"lib/image.bin":   "\x00before",
+		"lib/same.bin":    "\x00same",
+		"lib/removed.bin": "\x00removed",
+		"lib/text.txt":    "one\n",
+	}, map[string]string{
+		"lib/image.bin": "\x00after",
+		"lib/same.bin":  "\x00same",
+		"lib/added.bin": "\x00added",
+		"lib/text.txt":  "two\n",
+	}, map[string]string{
+		"vendor/image.bin":   "\x00before",
+		"vendor/same.bin":    "\x00same",
+		"vendor/removed.bin": "\x00removed",
+		"vendor/text.txt":    "one\n",
+	})
+
+	result := runDiff(t, ctx, &TaskDiff{Source: "lib", Destination: "vendor"})
+	expectChanges(t, result, []string{"vendor/added.bin", "vendor/image.bin"}, []string{"vendor/removed.bin"})
+	if len(result.Patches) != 1 || bytes.Contains(result.Patches[0].Body, []byte(".bin")) {
+		t.Errorf("expected a single patch of the text file, got %d patches", len(result.Patches))
+	}
+
+	for name, want := range map[string]string{
+		"vendor/image.bin": "\x00after",
+		"vendor/added.bin": "\x00added",
+		"vendor/text.txt":  "two\n",
+	} {
+		if got := readFile(t, filepath.Join(rootPath, name)); got != want {
+			t.Errorf("unexpected content of %s: %q", name, got)
+		}
+	}
+}
+
+func TestDiffBinaryFile(t *testing.T) {
+	ctx, rootPath := diffContext(t, map[string]string{
+		"image.bin": "\x00before",
+	}, map[string]string{
+		"image.bin": "\x00after",
+	}, map[string]string{
+		"image.bin": "\x00before",
+	})
+
+	result := runDiff(t, ctx, &TaskDiff{Source: "image.bin", Destination: "image.bin"})
+	expectChanges(t, result, []string{"image.bin"}, nil)
+	if len(result.Patches) != 0 {
+		t.Errorf("expected no patches, got %d", len(result.Patches))
+	}
+	if got := readFile(t, filepath.Join(rootPath, "image.bin")); got != "\x00after" {
+		t.Errorf("unexpected content %q", got)
+	}
+}
+
+func TestCommandNotAllowed(t *testing.T) {
+	ctx, _, _ := testContext(t, nil, nil)
+
+	_, err := (&TaskCommand{Command: "true"}).run(gmpctx.AllowCommandsIntoContext(ctx, false))
+	var notAllowedErr gmperr.ErrCommandsNotAllowed
+	if !errors.As(err, &notAllowedErr) {
+		t.Fatalf("expected ErrCommandsNotAllowed, got %v", err)
+	}
+	if notAllowedErr.Command != "true" {
+		t.Errorf("unexpected command %s", notAllowedErr.Command)
+	}
+}
+
+func TestCommandMutatesFiles(t *testing.T) {
+	for _, mutatesFiles := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mutates_files=%v", mutatesFiles), func(t *testing.T) {
+			ctx, _, rootPath := testContext(t, nil, nil)
+			ctx = gmpctx.AllowCommandsIntoContext(ctx, true)
+
+			result, err := (&TaskCommand{Command: "touch", Args: []string{"out.txt"}, Path: "sub", MutatesFiles: mutatesFiles}).run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			commands, checks := result.Commands, result.Checks
+			if !mutatesFiles {
+				commands, checks = checks, commands
+			}
+			if len(commands) != 1 || len(checks) != 0 {
+				t.Fatalf("expected a single command in the right list, got commands=%v checks=%v", result.Commands, result.Checks)
+			}
+			if want := filepath.Join(rootPath, "sub"); commands[0].Dir != want {
+				t.Errorf("expected the command to run in %s, got %s", want, commands[0].Dir)
+			}
+			// checks don't make a result worth committing on their own
+			if result.IsEmpty() != !mutatesFiles {
+				t.Errorf("expected IsEmpty=%v", !mutatesFiles)
+			}
+		})
+	}
+}
+
+func TestCommandErrorContainsStderr(t *testing.T) {
+	ctx, _, _ := testContext(t, nil, nil)
+	ctx = gmpctx.AllowCommandsIntoContext(ctx, true)
+
+	result, err := (&TaskCommand{Command: "sh", Args: []string{"-c", "echo checking; echo tests failed >&2; exit 1"}}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = result.ApplyCommands(ctx)
+	if err == nil {
+		t.Fatal("expected the check to fail")
+	}
+	for _, want := range []string{"stdout=[checking", "stderr=[tests failed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in the error, got %v", want, err)
+		}
+	}
+}
+
+func sha256Hex(content string) string {
+	digest := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestCopyExpectedSHA256(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{name: "match", expected: sha256Hex("new")},
+		{name: "mismatch", expected: sha256Hex("tampered"), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, upstreamPath, rootPath := testContext(t, map[string]string{"file.txt": "new"}, map[string]string{"file.txt": "old"})
+
+			err := (&Copy{
+				Source:         filepath.Join(upstreamPath, "file.txt"),
+				Destination:    "file.txt",
+				ExpectedSHA256: tc.expected,
+			}).Apply(ctx)
+
+			want := "new"
+			if tc.wantErr {
+				var mismatchErr gmperr.ErrChecksumMismatch
+				if !errors.As(err, &mismatchErr) {
+					t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+				}
+				if mismatchErr.Actual != sha256Hex("new") {
+					t.Errorf("unexpected actual digest %s", mismatchErr.Actual)
+				}
+				// the destination is left untouched
+				want = "old"
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := readFile(t, filepath.Join(rootPath, "file.txt")); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSyncDirectoryExpectedSHA256(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected map[string]string
+		// wantRunErr fails the run, wantApplyErr the copy of the file
+		wantRunErr   bool
+		wantApplyErr bool
+	}{
+		{name: "match", expected: map[string]string{"changed.txt": sha256Hex("new"), "unchanged.txt": sha256Hex("same")}},
+		{name: "match ignoring case", expected: map[string]string{"changed.txt": strings.ToUpper(sha256Hex("new"))}},
+		{name: "mismatch of changed file", expected: map[string]string{"changed.txt": sha256Hex("tampered")}, wantApplyErr: true},
+		{name: "mismatch of unchanged file", expected: map[string]string{"unchanged.txt": sha256Hex("tampered")}, wantRunErr: true},
+		{name: "file not synced", expected: map[string]string{"missing.txt": sha256Hex("new")}, wantRunErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, _, rootPath := testContext(t, map[string]string{
+				"src/changed.txt":   "new",
+				"src/unchanged.txt": "same",
+			}, map[string]string{
+				"dst/changed.txt":   "old",
+				"dst/unchanged.txt": "same",
+			})
+
+			result, err := (&TaskSyncDirectory{Source: "src", Destination: "dst", ExpectedSHA256: tc.expected}).run(ctx)
+			if tc.wantRunErr {
+				if err == nil {
+					t.Fatal("expected the run to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expectChanges(t, result, []string{"dst/changed.txt"}, nil)
+
+			err = result.Apply(ctx)
+			if tc.wantApplyErr {
+				var mismatchErr gmperr.ErrChecksumMismatch
+				if !errors.As(err, &mismatchErr) {
+					t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+				}
+				if got := readFile(t, filepath.Join(rootPath, "dst/changed.txt")); got != "old" {
+					t.Errorf("expected the mismatching file not to be copied, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := readFile(t, filepath.Join(rootPath, "dst/changed.txt")); got != "new" {
+				t.Errorf("unexpected content %q", got)
+			}
+		})
+	}
+}
+
+// numberedLines returns n lines of the form "line <i>", the lines given in
+// replace are substituted.
+func numberedLines(n int, replace map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		line, ok := replace[i]
+		if !ok {
+			line = fmt.Sprintf("line %d", i)
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+func TestDiffRoundTripGitBackend(t *testing.T) {
+	for _, format := range []DiffFormat{DiffFormatUnified, DiffFormatGit} {
+		for _, contextLines := range []int{0, 1, 3, 5} {
+			t.Run(fmt.Sprintf("%s/context_lines=%d", format, contextLines), func(t *testing.T) {
+				// the local change is far enough from the upstream change to
+				// stay outside of the context of the hunk
+				ctx, rootPath := diffContext(t, map[string]string{
+					"lib/file.txt": numberedLines(20, nil),
+				}, map[string]string{
+					"lib/file.txt":  numberedLines(20, map[int]string{8: "upstream 8"}),
+					"lib/added.txt": "added\n",
+				}, map[string]string{
+					"vendor/file.txt": numberedLines(20, map[int]string{19: "local 19"}),
+				})
+
+				result := runDiff(t, ctx, &TaskDiff{
+					Source:       "lib",
+					Destination:  "vendor",
+					Format:       format,
+					ContextLines: &contextLines,
+					PatchBackend: PatchBackendGit,
+				})
+
+				var context int
+				for _, p := range result.Patches {
+					if p.Backend != PatchBackendGit {
+						t.Errorf("expected the git backend, got %q", p.Backend)
+					}
+					for _, line := range strings.Split(string(p.Body), "\n") {
+						if strings.HasPrefix(line, " line ") {
+							context++
+						}
+					}
+				}
+				if context != 2*contextLines {
+					t.Errorf("expected %d context lines, got %d", 2*contextLines, context)
+				}
+
+				for name, want := range map[string]string{
+					"vendor/file.txt":  numberedLines(20, map[int]string{8: "upstream 8", 19: "local 19"}),
+					"vendor/added.txt": "added\n",
+				} {
+					if got := readFile(t, filepath.Join(rootPath, name)); got != want {
+						t.Errorf("unexpected content of %s: %q", name, got)
+					}
+				}
+			})
+		}
+	}
+}
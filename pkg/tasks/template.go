@@ -0,0 +1,118 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+// TemplateData is passed to the templates rendered by TaskTemplate.
+type TemplateData struct {
+	Path          string // module path of the package
+	BeforeVersion string
+	AfterVersion  string
+	BeforeRelease string // version without the pseudo-version suffix
+	AfterRelease  string
+	Hash          string // commit hash of the after version, empty for tags
+}
+
+// templateFuncs are helpers for common string operations, named after their
+// sprig counterparts.
+var templateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       func(sep string, elems []string) string { return strings.Join(elems, sep) },
+	"quote":      func(s string) string { return fmt.Sprintf("%q", s) },
+	"trunc": func(n int, s string) string {
+		if n < len(s) {
+			return s[:n]
+		}
+		return s
+	},
+	"default": func(d, s string) string {
+		if s == "" {
+			return d
+		}
+		return s
+	},
+}
+
+// TaskTemplate renders a text/template with the upstream version information
+// and writes it to the destination.
+type TaskTemplate struct {
+	// Template is the path of the template file relative to the root
+	Template string `yaml:"template" json:"template"`
+	// Destination is the path of the rendered file relative to the root
+	Destination string `yaml:"destination" json:"destination"`
+}
+
+func (t *TaskTemplate) run(ctx context.Context) (*Result, error) {
+	before, err := gmpctx.GoModBeforeFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+	after, err := gmpctx.GoModAfterFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rootPath, err := gmpctx.RootPathFromContextOrError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	templatePath := filepath.Join(rootPath, t.Template)
+	tmpl, err := template.New(filepath.Base(templatePath)).Funcs(templateFuncs).ParseFiles(templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, TemplateData{
+		Path:          after.Path,
+		BeforeVersion: string(before.Version),
+		AfterVersion:  string(after.Version),
+		BeforeRelease: before.Version.Release(),
+		AfterRelease:  after.Version.Release(),
+		Hash:          after.Version.Hash(),
+	}); err != nil {
+		return nil, fmt.Errorf("error rendering template '%s': %w", t.Template, err)
+	}
+
+	existing, err := ioutil.ReadFile(filepath.Join(rootPath, t.Destination))
+	if err == nil && bytes.Equal(existing, rendered.Bytes()) {
+		return &Result{}, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	renderedFile, err := ioutil.TempFile(gmpctx.TempDirFromContext(ctx), "template")
+	if err != nil {
+		return nil, err
+	}
+	defer renderedFile.Close()
+	if _, err := renderedFile.Write(rendered.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		FilesToCopy: []Copy{{
+			Source:      renderedFile.Name(),
+			Destination: t.Destination,
+		}},
+	}, nil
+}
@@ -0,0 +1,77 @@
+package tasks
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/go-mod-promote/pkg/api"
+	gmpctx "github.com/grafana/go-mod-promote/pkg/context"
+)
+
+// templateContext returns a context for template tasks, the upstream module
+// is updated from v1.0.0 to a pseudo-version.
+func templateContext(t *testing.T, root map[string]string) (ctx context.Context, rootPath string) {
+	t.Helper()
+	ctx, _, rootPath = testContext(t, nil, root)
+	ctx = gmpctx.TempDirIntoContext(ctx, t.TempDir())
+	ctx = gmpctx.GoModBeforeIntoContext(ctx, &api.GoModDownloadResult{Path: "example.com/up", Version: "v1.0.0"})
+	ctx = gmpctx.GoModAfterIntoContext(ctx, &api.GoModDownloadResult{Path: "example.com/up", Version: "v1.1.1-0.20201012100000-abcdef123456"})
+	return ctx, rootPath
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "data", template: "{{.Path}} {{.BeforeVersion}} {{.AfterRelease}} {{.Hash}}", want: "example.com/up v1.0.0 v1.1.1 abcdef123456"},
+		{name: "trimPrefix", template: `{{trimPrefix "example.com/" .Path}}`, want: "up"},
+		{name: "trimSuffix", template: `{{.Path | trimSuffix "/up"}}`, want: "example.com"},
+		{name: "replace", template: `{{replace "." "_" .AfterRelease}}`, want: "v1_1_1"},
+		{name: "join", template: `{{join "-" (split "/" .Path)}}`, want: "example.com-up"},
+		{name: "contains", template: `{{if contains "example" .Path}}yes{{end}}`, want: "yes"},
+		{name: "hasPrefix", template: `{{if hasPrefix "v1." .AfterRelease}}yes{{end}}`, want: "yes"},
+		{name: "trunc", template: `{{trunc 7 .Hash}}`, want: "abcdef1"},
+		{name: "default", template: `{{default "none" .Hash}} {{default "none" ""}}`, want: "abcdef123456 none"},
+		{name: "upper and quote", template: `{{.Path | upper | quote}}`, want: `"EXAMPLE.COM/UP"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, rootPath := templateContext(t, map[string]string{"version.tmpl": tc.template})
+
+			result, err := (&TaskTemplate{Template: "version.tmpl", Destination: "version.txt"}).run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := result.Apply(ctx); err != nil {
+				t.Fatalf("error applying template: %v", err)
+			}
+			if got := readFile(t, filepath.Join(rootPath, "version.txt")); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTemplateIntoNewDirectory(t *testing.T) {
+	ctx, rootPath := templateContext(t, map[string]string{"CHANGELOG.tmpl": "{{.Path}} {{.AfterVersion}}\n"})
+
+	result, err := (&TaskTemplate{Template: "CHANGELOG.tmpl", Destination: "docs/generated/CHANGELOG.md"}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := result.Apply(ctx); err != nil {
+		t.Fatalf("error applying template: %v", err)
+	}
+	if got := readFile(t, filepath.Join(rootPath, "docs/generated/CHANGELOG.md")); got != "example.com/up v1.1.1-0.20201012100000-abcdef123456\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+
+	// rendering again without changes leaves the file alone
+	result, err = (&TaskTemplate{Template: "CHANGELOG.tmpl", Destination: "docs/generated/CHANGELOG.md"}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChanges(t, result, nil, nil)
+}